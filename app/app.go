@@ -1,20 +1,39 @@
 package app
 
 import (
-	"database/sql"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/audit"
+	"github.com/vladkonst/metrics-alerting/internal/cardinality"
 	"github.com/vladkonst/metrics-alerting/internal/configs"
+	"github.com/vladkonst/metrics-alerting/internal/encryption"
+	"github.com/vladkonst/metrics-alerting/internal/logger"
+	"github.com/vladkonst/metrics-alerting/internal/migrations"
 	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/pgretry"
 	"github.com/vladkonst/metrics-alerting/internal/storage"
+	"github.com/vladkonst/metrics-alerting/internal/telemetry"
+	"github.com/vladkonst/metrics-alerting/internal/tlsconfig"
+	"github.com/vladkonst/metrics-alerting/internal/tokens"
+	"github.com/vladkonst/metrics-alerting/internal/wal"
 )
 
 var timings = []time.Duration{0, time.Second, time.Second * 3, time.Second * 5}
@@ -26,47 +45,238 @@ type App struct {
 	done            *chan bool
 	cfg             *configs.ServerCfg
 	hasher          *handlers.Hasher
+	updateLimiter   *handlers.RateLimiter
+	updatesLimiter  *handlers.RateLimiter
+	privateKey      *rsa.PrivateKey
+	tlsReloader     *tlsconfig.Reloader
+	trustedSubnets  []*net.IPNet
+	auth            *handlers.Authenticator
+	auditor         *audit.Auditor
+	backend         string
+	storageClosers  []io.Closer
+	health          *handlers.Health
 }
 
 func NewApp(done *chan bool, cfg *configs.ServerCfg) (*App, error) {
+	if cfg.IntervalsCfg.TLSRequireClientCert && (cfg.IntervalsCfg.TLSCert == "" || cfg.IntervalsCfg.TLSClientCA == "") {
+		return nil, errors.New("requiring client certificates needs a server certificate and a client CA")
+	}
+
 	ps := cfg.IntervalsCfg.DatabaseDSN
 	var s handlers.MetricRepository
-	var conn *sql.DB
-	h := handlers.NewHasher(cfg.IntervalsCfg.HashKey)
+	var conn *pgxpool.Pool
+	var pinger handlers.Pinger
+	guard := handlers.NewReplayGuard(time.Duration(cfg.IntervalsCfg.ReplayWindow)*time.Second, cfg.IntervalsCfg.NonceCacheSize)
+	h := handlers.NewHasher(cfg.IntervalsCfg.HashKey, guard)
 	metricsCh := make(chan models.Metrics)
-	switch ps {
-	case "":
+	backend := cfg.IntervalsCfg.Storage
+	if backend == "" {
+		backend = configs.StorageMemory
+		if ps != "" {
+			backend = configs.StoragePostgres
+		}
+	}
+
+	var closer io.Closer
+	switch backend {
+	case configs.StorageMemory:
 		s = storage.NewMemStorage(&metricsCh)
+	case configs.StorageEmbedded:
+		bs, err := storage.NewBoltStorage(cfg.IntervalsCfg.StoragePath)
+		if err != nil {
+			return nil, err
+		}
+		s, closer = bs, bs
+	case configs.StoragePostgres:
+		if ps == "" {
+			return nil, errors.New("postgres storage needs a database connection string")
+		}
+
+		var err error
+		conn, err = Connect(context.Background(), ps, cfg.IntervalsCfg.DBMaxConns, cfg.IntervalsCfg.DBMinConns)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := migrations.Up(context.Background(), conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if n > 0 {
+			log.Printf("applied %d schema migrations", n)
+		}
+
+		breaker := pgretry.NewBreaker(cfg.IntervalsCfg.DBBreakerThreshold, time.Duration(cfg.IntervalsCfg.DBBreakerCooldown)*time.Second)
+		pg := storage.NewPGStorage(conn, breaker)
+		s, pinger = pg, pg
+		closer = closerFunc(func() error { conn.Close(); return nil })
 	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+
+	closers := make([]io.Closer, 0)
+	if closer != nil {
+		closers = append(closers, closer)
+	}
+
+	if cfg.IntervalsCfg.CacheEnabled && backend != configs.StorageMemory {
+		var notifier storage.Notifier
+		if conn != nil {
+			notifier = storage.NewPGNotifier(conn, replicaID())
+		}
+
+		cs, err := storage.NewCachedStorage(s, time.Duration(cfg.IntervalsCfg.CacheFlushInterval)*time.Millisecond, notifier)
+		if err != nil {
+			return nil, err
+		}
+
+		// The cache flushes into the backend, so it is closed first. Closing
+		// it also stops the notifier, which holds a pool connection.
+		s = cs
+		closers = append([]io.Closer{cs}, closers...)
+	}
+
+	s = storage.NewInstrumentedStorage(s)
+
+	var priv *rsa.PrivateKey
+	if cfg.IntervalsCfg.CryptoKey != "" {
+		var err error
+		if priv, err = encryption.LoadPrivateKey(cfg.IntervalsCfg.CryptoKey); err != nil {
+			return nil, err
+		}
+	}
+
+	var reloader *tlsconfig.Reloader
+	if cfg.IntervalsCfg.TLSCert != "" {
 		var err error
-		conn, err = RetriableConnect(ps)
+		reloader, err = tlsconfig.NewReloader(cfg.IntervalsCfg.TLSCert, cfg.IntervalsCfg.TLSKey, cfg.IntervalsCfg.TLSClientCA)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		s = storage.NewPGStorage(conn)
+	subnets, err := handlers.ParseSubnets(cfg.IntervalsCfg.TrustedSubnet)
+	if err != nil {
+		return nil, err
 	}
 
-	sp := &handlers.StorageProvider{Storage: s, MetricsChan: &metricsCh, DB: conn}
-	return &App{Storage: s, MetricsChan: &metricsCh, StorageProvider: sp, done: done, cfg: cfg, hasher: h}, nil
-}
+	var auth *handlers.Authenticator
+	if cfg.IntervalsCfg.AuthEnabled {
+		var ts tokens.Store = tokens.NewFileStore(cfg.IntervalsCfg.TokensFile)
+		if conn != nil {
+			ts = tokens.NewPGStore(conn)
+		}
+		auth = handlers.NewAuthenticator(ts)
+	}
 
-func RetriableConnect(ps string) (*sql.DB, error) {
-	var err error
-	var conn *sql.DB
-	for i := 0; i < 4; i++ {
-		time.Sleep(timings[i])
-		conn, err = sql.Open("pgx", ps)
+	sinks := make([]audit.Sink, 0)
+	if cfg.IntervalsCfg.AuditFile != "" {
+		fs, err := audit.NewFileSink(cfg.IntervalsCfg.AuditFile)
 		if err != nil {
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr) && pgerrcode.IsConnectionException(pgErr.Code) {
-				log.Println(err)
-				continue
-			}
 			return nil, err
 		}
-		return conn, nil
+		sinks = append(sinks, fs)
 	}
+
+	if cfg.IntervalsCfg.AuditURL != "" {
+		sinks = append(sinks, audit.NewHTTPSink(cfg.IntervalsCfg.AuditURL))
+	}
+
+	auditor := audit.NewAuditor(cfg.IntervalsCfg.AuditBuffer, sinks...)
+	ct := cardinality.NewTracker(cfg.IntervalsCfg.MaxSeries, cfg.IntervalsCfg.MaxSeriesPerSource)
+	health := handlers.NewHealth()
+	sp := &handlers.StorageProvider{Storage: s, MetricsChan: &metricsCh, DB: pinger, Cardinality: ct, Auditor: auditor, Health: health}
+	health.AddCheck("storage", func(ctx context.Context) handlers.ComponentStatus {
+		cs := handlers.ComponentStatus{Status: handlers.StatusOK}
+		if p, ok := s.(handlers.Pinger); ok {
+			cs = handlers.CheckError(p.Ping(ctx))
+		}
+		cs.Details = map[string]any{"backend": backend, "cached": cfg.IntervalsCfg.CacheEnabled && backend != configs.StorageMemory}
+		return cs
+	})
+	telemetry.Default.GaugeFunc("metrics_queue_depth", "Metrics waiting to be persisted.", func() float64 {
+		return float64(sp.QueueDepth())
+	})
+	maxQueue := cfg.IntervalsCfg.ReadyMaxQueue
+	health.AddCheck("ingestion", func(context.Context) handlers.ComponentStatus {
+		depth := sp.QueueDepth()
+		cs := handlers.ComponentStatus{Status: handlers.StatusOK, Details: map[string]any{"queue_depth": depth}}
+		if maxQueue > 0 && depth > int64(maxQueue) {
+			cs.Status = handlers.StatusFail
+			cs.Error = fmt.Sprintf("%d metrics are waiting to be persisted", depth)
+		}
+		return cs
+	})
+	return &App{
+		Storage:         s,
+		MetricsChan:     &metricsCh,
+		StorageProvider: sp,
+		done:            done,
+		cfg:             cfg,
+		hasher:          h,
+		updateLimiter:   handlers.NewRateLimiter(cfg.IntervalsCfg.UpdateRateLimit, cfg.IntervalsCfg.UpdateBurst),
+		updatesLimiter:  handlers.NewRateLimiter(cfg.IntervalsCfg.UpdatesRateLimit, cfg.IntervalsCfg.UpdatesBurst),
+		privateKey:      priv,
+		tlsReloader:     reloader,
+		trustedSubnets:  subnets,
+		auth:            auth,
+		auditor:         auditor,
+		backend:         backend,
+		storageClosers:  closers,
+		health:          health,
+	}, nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// replicaID identifies this server among the replicas sharing a database.
+func replicaID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Connect opens a connection pool and waits for the database to answer,
+// retrying connection failures.
+func Connect(ctx context.Context, dsn string, maxConns, minConns int) (*pgxpool.Pool, error) {
+	pcfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxConns > 0 {
+		pcfg.MaxConns = int32(maxConns)
+	}
+	if minConns > 0 {
+		pcfg.MinConns = int32(minConns)
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, pcfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(timings); i++ {
+		time.Sleep(timings[i])
+		if err = pool.Ping(ctx); err == nil {
+			return pool, nil
+		}
+
+		var connErr *pgconn.ConnectError
+		if !pgretry.Retryable(err) && !errors.As(err, &connErr) {
+			break
+		}
+		log.Println(err)
+	}
+
+	pool.Close()
 	return nil, err
 }
 
@@ -78,33 +288,305 @@ func (a *App) GetStorage() handlers.MetricRepository {
 	return a.Storage
 }
 
-func (a App) Run() {
-	fileStorage, err := storage.NewFileManager(a.cfg.IntervalsCfg.FileStoragePath, a.cfg.IntervalsCfg.Restore, a.cfg.IntervalsCfg.StoreInterval, a.MetricsChan, a.Storage)
+// Run serves requests until done receives a value. The server listens while
+// the persisted metrics are restored but is only ready afterwards. On
+// shutdown it stops being ready, drains in-flight requests, stops the
+// background goroutines and persists the final snapshot, all within the
+// shutdown timeout. The returned error joins everything that went wrong on
+// the way.
+func (a *App) Run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	failed := make(chan error, 2)
+
+	srv := &http.Server{Addr: a.cfg.NetAddressCfg.String(), Handler: a.GetRouter(), TLSConfig: a.TLSConfig()}
+	if a.tlsReloader != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.tlsReloader.Watch(ctx, time.Duration(a.cfg.IntervalsCfg.TLSReloadInterval)*time.Second)
+		}()
+	}
+
+	go func() {
+		var err error
+		if srv.TLSConfig == nil {
+			err = srv.ListenAndServe()
+		} else {
+			err = srv.ListenAndServeTLS("", "")
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			failed <- err
+		}
+	}()
+
+	fileStorage, err := a.restore()
 	if err != nil {
-		log.Panic(err)
+		return errors.Join(err, a.shutdown(srv, cancel, &wg, nil))
 	}
 
+	if fileStorage != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fileStorage.ProcessMetrics(ctx); err != nil {
+				failed <- fmt.Errorf("persist metrics: %w", err)
+			}
+		}()
+	}
+
+	wg.Add(1)
 	go func() {
-		if err := fileStorage.ProcessMetrics(); err != nil {
-			log.Panic(err)
+		defer wg.Done()
+		// Handlers block until their metrics are received, so the channel
+		// is drained until shutdown.
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-*a.MetricsChan:
+			}
 		}
 	}()
 
+	if interval := a.cfg.IntervalsCfg.SelfMetricsInterval; interval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.storeSelfMetrics(ctx, time.Duration(interval)*time.Second)
+		}()
+	}
+
+	a.health.SetState(handlers.StateServing)
+	select {
+	case <-*a.done:
+	case err = <-failed:
+	}
+
+	return errors.Join(err, a.shutdown(srv, cancel, &wg, fileStorage))
+}
+
+// selfMetricsSource is the cardinality source of the server's own metrics.
+const selfMetricsSource = "self"
+
+// storeSelfMetrics writes the server's own metrics into the storage as
+// server_* gauges until ctx is done. They count against the cardinality
+// limits like client metrics.
+func (a *App) storeSelfMetrics(ctx context.Context, interval time.Duration) {
+	log := logger.Get()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := a.StorageProvider.StoreInternal(ctx, selfMetricsSource, telemetry.Default.Metrics()); err != nil && ctx.Err() == nil {
+			log.Error().Err(err).Msg("failed to store self metrics")
+		}
+	}
+}
+
+// restore loads the persisted metrics of the memory storage and registers
+// the stored series with the cardinality tracker. The embedded and Postgres
+// storages keep their metrics themselves, so they get no file journal.
+func (a *App) restore() (*storage.FileManager, error) {
+	a.health.SetState(handlers.StateRestoring)
+	var fileStorage *storage.FileManager
+	if a.backend == configs.StorageMemory {
+		var err error
+		if fileStorage, err = a.newFileManager(); err != nil {
+			return nil, err
+		}
+
+		a.StorageProvider.Persistence = fileStorage
+		a.health.AddCheck("file", func(context.Context) handlers.ComponentStatus {
+			cs := handlers.CheckError(fileStorage.Err())
+			cs.Details = map[string]any{"path": a.cfg.IntervalsCfg.FileStoragePath}
+			return cs
+		})
+	}
+
+	if err := a.seedCardinality(); err != nil {
+		return nil, err
+	}
+
+	return fileStorage, nil
+}
+
+// shutdown drains the server before stopping the goroutines consuming
+// MetricsChan, because handlers send to it until they return. Readiness
+// reports draining for the drain delay, if one is set, before the listeners are
+// closed. A zero timeout waits as long as it takes.
+func (a *App) shutdown(srv *http.Server, stop context.CancelFunc, wg *sync.WaitGroup, fileStorage *storage.FileManager) error {
+	log := logger.Get()
+	a.health.SetState(handlers.StateDraining)
+	if delay := time.Duration(a.cfg.IntervalsCfg.DrainDelay) * time.Second; delay > 0 {
+		log.Info().Dur("delay", delay).Msg("reporting not ready before draining")
+		time.Sleep(delay)
+	}
+
+	timeout := time.Duration(a.cfg.IntervalsCfg.ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+	defer cancel()
+
+	log.Info().Dur("timeout", timeout).Msg("shutting down")
+	var drainErr error
+	if err := srv.Shutdown(ctx); err != nil {
+		drainErr = fmt.Errorf("drain requests: %w", err)
+		srv.Close()
+	}
+
+	stop()
+	done := make(chan error, 1)
 	go func() {
-		log.Panic(http.ListenAndServe(a.cfg.NetAddressCfg.String(), a.GetRouter()))
+		wg.Wait()
+		var errs []error
+		if fileStorage != nil {
+			if err := fileStorage.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("write final snapshot: %w", err))
+			}
+		}
+
+		for _, c := range a.storageClosers {
+			if err := c.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("close storage: %w", err))
+			}
+		}
+
+		if a.auditor != nil {
+			a.auditor.Close()
+		}
+		done <- errors.Join(errs...)
 	}()
 
-	<-*a.done
-	fileStorage.LoadMetrics()
+	select {
+	case err := <-done:
+		return errors.Join(drainErr, err)
+	case <-ctx.Done():
+		return errors.Join(drainErr, errors.New("shutdown timed out before the metrics were persisted"))
+	}
+}
+
+// Ready reports whether the server is serving: it is false until Run has
+// restored the metrics and again once the shutdown has begun.
+func (a *App) Ready() bool {
+	return a.health.Ready()
+}
+
+func (a *App) newFileManager() (*storage.FileManager, error) {
+	walOpts, err := a.walOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	encoding, err := storage.ParseEncoding(a.cfg.IntervalsCfg.SnapshotEncoding)
+	if err != nil {
+		return nil, err
+	}
+
+	snapOpts := storage.SnapshotOptions{Encoding: encoding, Keep: a.cfg.IntervalsCfg.SnapshotKeep}
+	return storage.NewFileManager(a.cfg.IntervalsCfg.FileStoragePath, a.cfg.IntervalsCfg.Restore, a.cfg.IntervalsCfg.StoreInterval, a.Storage, snapOpts, walOpts)
+}
+
+// walOptions returns the write-ahead log settings or nil when the log is
+// disabled.
+func (a *App) walOptions() (*storage.WALOptions, error) {
+	cfg := a.cfg.IntervalsCfg
+	if cfg.WALPath == "" {
+		return nil, nil
+	}
+
+	if cfg.WALCheckpointInterval < 0 {
+		return nil, errors.New("the WAL checkpoint interval can't be negative")
+	}
+
+	policy, err := wal.ParseSyncPolicy(cfg.WALSync)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storage.WALOptions{
+		Path:               cfg.WALPath,
+		Sync:               policy,
+		SyncInterval:       time.Duration(cfg.WALSyncInterval) * time.Millisecond,
+		CheckpointInterval: time.Duration(cfg.WALCheckpointInterval) * time.Second,
+	}, nil
+}
+
+// TLSConfig returns the server TLS configuration or nil when TLS is disabled.
+func (a *App) TLSConfig() *tls.Config {
+	if a.tlsReloader == nil {
+		return nil
+	}
+
+	return tlsconfig.ServerConfig(a.tlsReloader, a.cfg.IntervalsCfg.TLSRequireClientCert)
+}
+
+// seedCardinality registers series that are already stored, so restored
+// metrics count against the limits.
+func (a *App) seedCardinality() error {
+	ctx := context.Background()
+	gauges, err := a.Storage.GetGaugesValues(ctx)
+	if err != nil {
+		return err
+	}
+
+	counters, err := a.Storage.GetCountersValues(ctx)
+	if err != nil {
+		return err
+	}
+
+	for name := range gauges {
+		a.StorageProvider.Cardinality.Seed("", "gauge", name)
+	}
+
+	for name := range counters {
+		a.StorageProvider.Cardinality.Seed("", "counter", name)
+	}
+
+	return nil
+}
+
+// require returns a middleware checking the API token scope, or a no-op one
+// when authentication is disabled.
+func (a *App) require(scope tokens.Scope) func(http.Handler) http.Handler {
+	if a.auth == nil {
+		return func(next http.Handler) http.Handler { return next }
+	}
+
+	return a.auth.Require(scope)
 }
 
 func (a *App) GetRouter() http.Handler {
 	r := chi.NewRouter()
-	r.Get("/", a.StorageProvider.GetMetricsPage)
+	r.With(a.require(tokens.ScopeRead)).Get("/", a.StorageProvider.GetMetricsPage)
+
+	r.With(a.require(tokens.ScopeRead)).Get("/api/v1/cardinality", a.StorageProvider.GetCardinalityReport)
+
+	r.With(a.require(tokens.ScopeRead)).Get("/debug/metrics", telemetry.Default.Handler().ServeHTTP)
 
 	r.Get("/ping", a.StorageProvider.PingDB)
+	r.Get("/healthz", a.health.GetHealth)
+	r.Get("/readyz", a.health.GetReadiness)
+
+	r.Route("/admin", func(r chi.Router) {
+		if len(a.trustedSubnets) > 0 {
+			r.Use(handlers.TrustedSubnetMiddleware(a.trustedSubnets))
+		}
+		r.Use(a.require(tokens.ScopeAdmin))
+		r.Get("/backup", a.StorageProvider.Backup)
+		r.Post("/restore", a.StorageProvider.Restore)
+	})
 
 	r.Route("/value", func(r chi.Router) {
+		r.Use(a.require(tokens.ScopeRead))
 		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 			{
 				http.Error(w, "Bad request.", http.StatusBadRequest)
@@ -153,6 +635,13 @@ func (a *App) GetRouter() http.Handler {
 	})
 
 	r.Route("/updates", func(r chi.Router) {
+		if len(a.trustedSubnets) > 0 {
+			r.Use(handlers.TrustedSubnetMiddleware(a.trustedSubnets))
+		}
+		r.Use(a.require(tokens.ScopeWrite), a.health.GateWrites)
+		if a.updatesLimiter != nil {
+			r.Use(a.updatesLimiter.Middleware)
+		}
 		r.Post("/", a.StorageProvider.UpdateMetrics)
 		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
@@ -166,6 +655,13 @@ func (a *App) GetRouter() http.Handler {
 	})
 
 	r.Route("/update", func(r chi.Router) {
+		if len(a.trustedSubnets) > 0 {
+			r.Use(handlers.TrustedSubnetMiddleware(a.trustedSubnets))
+		}
+		r.Use(a.require(tokens.ScopeWrite), a.health.GateWrites)
+		if a.updateLimiter != nil {
+			r.Use(a.updateLimiter.Middleware)
+		}
 		r.Post("/", a.StorageProvider.UpdateMetric)
 		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
@@ -231,9 +727,15 @@ func (a *App) GetRouter() http.Handler {
 		})
 	})
 
+	var h http.Handler = r
 	if a.hasher != nil {
-		return handlers.GzipMiddleware(handlers.LogRequest(a.hasher.HashMiddleware(r)))
+		h = a.hasher.HashMiddleware(h)
+	}
+
+	h = handlers.GzipMiddleware(handlers.LogRequest(handlers.TLSIdentityMiddleware(h)))
+	if a.privateKey != nil {
+		h = handlers.DecryptMiddleware(a.privateKey)(h)
 	}
 
-	return handlers.GzipMiddleware(handlers.LogRequest(r))
+	return h
 }
@@ -0,0 +1,176 @@
+package app_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/app"
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/configs"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/storage"
+	"github.com/vladkonst/metrics-alerting/internal/wal"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.txt")
+	port := freePort(t)
+	cfg := configs.ServerCfg{
+		IntervalsCfg:  &configs.ServerIntervalsCfg{FileStoragePath: path, StoreInterval: 300, SnapshotEncoding: "json", ShutdownTimeout: 5},
+		NetAddressCfg: &configs.NetAddressCfg{Host: "127.0.0.1", Port: port},
+	}
+	done := make(chan bool)
+	a, err := app.NewApp(&done, &cfg)
+	require.NoError(t, err)
+	assert.False(t, a.Ready())
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- a.Run() }()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/update/counter/c/5", port)
+	require.Eventually(t, func() bool {
+		res, err := http.Post(url, "text/plain", nil)
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return res.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, a.Ready())
+
+	res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/readyz", port))
+	require.NoError(t, err)
+	var readiness handlers.Readiness
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&readiness))
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, handlers.StateServing, readiness.State)
+	for _, name := range []string{"storage", "file", "ingestion"} {
+		assert.Equal(t, handlers.StatusOK, readiness.Components[name].Status, name)
+	}
+
+	done <- true
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after shutdown")
+	}
+	assert.False(t, a.Ready())
+
+	_, err = http.Post(url, "text/plain", nil)
+	assert.Error(t, err, "the server must not accept requests after shutdown")
+
+	ch := make(chan models.Metrics)
+	ms := storage.NewMemStorage(&ch)
+	_, err = storage.NewFileManager(path, true, 300, ms, storage.SnapshotOptions{}, nil)
+	require.NoError(t, err)
+	counters, err := ms.GetCountersValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"c": 5}, counters)
+}
+
+func TestWALWrittenBeforeResponse(t *testing.T) {
+	dir := t.TempDir()
+	path, walPath := filepath.Join(dir, "metrics.txt"), filepath.Join(dir, "metrics.wal")
+	port := freePort(t)
+	cfg := configs.ServerCfg{
+		IntervalsCfg: &configs.ServerIntervalsCfg{
+			FileStoragePath: path, SnapshotEncoding: "json", ShutdownTimeout: 5,
+			WALPath: walPath, WALSync: "always",
+		},
+		NetAddressCfg: &configs.NetAddressCfg{Host: "127.0.0.1", Port: port},
+	}
+	done := make(chan bool)
+	a, err := app.NewApp(&done, &cfg)
+	require.NoError(t, err)
+	stopped := make(chan error, 1)
+	go func() { stopped <- a.Run() }()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/update/counter/c/5", port)
+	require.Eventually(t, func() bool {
+		res, err := http.Post(url, "text/plain", nil)
+		if err != nil {
+			return false
+		}
+		res.Body.Close()
+		return res.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	l, records, err := wal.Open(walPath, wal.SyncAlways, 0)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+	require.Len(t, records, 1)
+	assert.Equal(t, int64(5), *records[0].Delta)
+
+	done <- true
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after shutdown")
+	}
+
+	ch := make(chan models.Metrics)
+	ms := storage.NewMemStorage(&ch)
+	_, err = storage.NewFileManager(path, true, 0, ms, storage.SnapshotOptions{}, nil)
+	require.NoError(t, err)
+	counters, err := ms.GetCountersValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"c": 5}, counters)
+}
+
+func TestDrainDelay(t *testing.T) {
+	port := freePort(t)
+	cfg := configs.ServerCfg{
+		IntervalsCfg: &configs.ServerIntervalsCfg{
+			FileStoragePath: filepath.Join(t.TempDir(), "metrics.txt"), StoreInterval: 300, SnapshotEncoding: "json",
+			ShutdownTimeout: 5, DrainDelay: 1,
+		},
+		NetAddressCfg: &configs.NetAddressCfg{Host: "127.0.0.1", Port: port},
+	}
+	done := make(chan bool)
+	a, err := app.NewApp(&done, &cfg)
+	require.NoError(t, err)
+	stopped := make(chan error, 1)
+	go func() { stopped <- a.Run() }()
+	require.Eventually(t, a.Ready, 5*time.Second, 10*time.Millisecond)
+
+	done <- true
+	require.Eventually(t, func() bool { return !a.Ready() }, time.Second, time.Millisecond)
+	res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/readyz", port))
+	require.NoError(t, err, "the listener stays open during the drain delay")
+	var readiness handlers.Readiness
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&readiness))
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	assert.Equal(t, handlers.StateDraining, readiness.State)
+
+	res, err = http.Post(fmt.Sprintf("http://127.0.0.1:%d/update/counter/c/1", port), "text/plain", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	select {
+	case err := <-stopped:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after shutdown")
+	}
+}
@@ -3,138 +3,333 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/vladkonst/metrics-alerting/handlers"
 	"github.com/vladkonst/metrics-alerting/internal/agent"
 	"github.com/vladkonst/metrics-alerting/internal/configs"
+	"github.com/vladkonst/metrics-alerting/internal/encryption"
 	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/signing"
+	"github.com/vladkonst/metrics-alerting/internal/tlsconfig"
 )
 
 var timings = []time.Duration{0, time.Second, time.Second * 3, time.Second * 5}
 
+// maxRetryAfter caps the delay a rate limited report waits for.
+const maxRetryAfter = 30 * time.Second
+
+const tlsReloadInterval = 30 * time.Second
+
 type hasher struct {
-	hash hash.Hash
+	key []byte
 }
 
 func NewHasher(key string) *hasher {
 	if key == "" {
 		return nil
 	}
-	hash := sha256.New()
-	return &hasher{hash}
+	return &hasher{key: []byte(key)}
 }
 
 func (h *hasher) hashBody(body []byte) []byte {
-	_, err := h.hash.Write(body)
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+type sender struct {
+	cfg       *configs.ClientCfg
+	hasher    *hasher
+	publicKey *rsa.PublicKey
+	client    *http.Client
+	scheme    string
+	realIP    string
+}
+
+func newSender(cfg *configs.ClientCfg) (*sender, error) {
+	s := &sender{cfg: cfg, hasher: NewHasher(cfg.IntervalsCfg.HashKey), client: http.DefaultClient, scheme: "http"}
+	if cfg.IntervalsCfg.CryptoKey != "" {
+		pub, err := encryption.LoadPublicKey(cfg.IntervalsCfg.CryptoKey)
+		if err != nil {
+			return nil, err
+		}
+		s.publicKey = pub
+	}
+
+	ip, err := outboundIP(cfg.NetAddressCfg.String())
 	if err != nil {
-		log.Panic("failed to hash request body")
+		log.Println("can't determine outbound address:", err)
+	}
+	s.realIP = ip
+
+	if cfg.IntervalsCfg.TLSCA != "" || cfg.IntervalsCfg.TLSCert != "" {
+		r, err := tlsconfig.NewReloader(cfg.IntervalsCfg.TLSCert, cfg.IntervalsCfg.TLSKey, cfg.IntervalsCfg.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+
+		go r.Watch(context.Background(), tlsReloadInterval)
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsconfig.ClientConfig(r)
+		s.client = &http.Client{Transport: transport}
+		s.scheme = "https"
 	}
 
-	dst := h.hash.Sum(nil)
-	return dst
+	return s, nil
 }
 
-func sendRequest(metricsJobs chan models.Metrics, serverAddr *configs.NetAddressCfg, tryCount int, h *hasher) {
-	if tryCount == 4 {
-		return
+// outboundIP returns the local address used to reach the server. Dialing
+// UDP only selects the route, nothing is sent.
+func outboundIP(serverAddr string) (string, error) {
+	conn, err := net.Dial("udp", serverAddr)
+	if err != nil {
+		return "", err
 	}
 
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+func (s *sender) sendRequest(metricsJobs chan models.Metrics) {
 	metrics := make([]models.Metrics, 0)
 	for m := range metricsJobs {
 		metrics = append(metrics, m)
 	}
 
-	b, err := json.Marshal(metrics)
+	// The other workers may have taken every queued metric.
+	if len(metrics) == 0 {
+		return
+	}
 
+	batchSize.Observe(float64(len(metrics)))
+	rejected, err := s.send(metrics)
 	if err != nil {
+		sendErrors.Inc()
+		dropped.Add(float64(len(metrics)))
 		log.Println(err)
 		return
 	}
 
+	batchesSent.Inc()
+	dropped.Add(float64(rejected))
+}
+
+// send delivers a batch, retrying when the server can't be reached or asks
+// to slow down. It returns the number of metrics the server rejected.
+func (s *sender) send(metrics []models.Metrics) (int, error) {
+	cfg, h := s.cfg, s.hasher
+	b, err := json.Marshal(metrics)
+	if err != nil {
+		return 0, err
+	}
+
 	buff := bytes.NewBuffer(nil)
 	zb := gzip.NewWriter(buff)
 	_, err = zb.Write(b)
 	if err != nil {
-		log.Println(err)
-		return
+		return 0, err
 	}
 
 	err = zb.Close()
 	if err != nil {
-		log.Println(err)
-		return
+		return 0, err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/updates/", serverAddr.String()), buff)
-	if err != nil {
-		log.Println(err)
-		return
+	body := buff.Bytes()
+	if s.publicKey != nil {
+		body, err = encryption.Encrypt(s.publicKey, body)
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	// if h != nil {
-	// 	hashedBody := h.hashBody(b)
-	// 	req.Header.Set("HashSHA256", hex.EncodeToString(hashedBody))
-	// }
+	var resp *http.Response
+	for tryCount := 0; tryCount < len(timings); tryCount++ {
+		req, err := http.NewRequest("POST", fmt.Sprintf("%s://%s/updates/", s.scheme, cfg.NetAddressCfg.String()), bytes.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
 
-	req.Header.Set("Content-Encoding", "gzip")
-	req.Header.Set("Accept-Encoding", "gzip")
-	req.Header.Set("Content-Type", "application/json")
-	if tryCount > 0 {
-		time.Sleep(timings[tryCount])
+		if h != nil {
+			ts := strconv.FormatInt(time.Now().Unix(), 10)
+			nonce, err := newNonce()
+			if err != nil {
+				return 0, err
+			}
+
+			hashedBody := h.hashBody(signing.Material(ts, nonce, b))
+			req.Header.Set(handlers.HashHeader, hex.EncodeToString(hashedBody))
+			req.Header.Set(handlers.TimestampHeader, ts)
+			req.Header.Set(handlers.NonceHeader, nonce)
+		}
+
+		if s.publicKey != nil {
+			req.Header.Set(handlers.EncryptionHeader, handlers.EncryptionScheme)
+		}
+
+		req.Header.Set("Content-Encoding", "gzip")
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("Content-Type", "application/json")
+		if cfg.IntervalsCfg.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+cfg.IntervalsCfg.Token)
+		}
+
+		if s.realIP != "" {
+			req.Header.Set(handlers.RealIPHeader, s.realIP)
+		}
+
+		start := time.Now()
+		resp, err = s.client.Do(req)
+		sendDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			var opError *net.OpError
+			if errors.As(err, &opError) && opError.Op == "dial" && tryCount+1 < len(timings) {
+				retries.Inc("dial")
+				time.Sleep(timings[tryCount+1])
+				continue
+			}
+			return 0, err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && tryCount+1 < len(timings) {
+			wait := retryAfter(resp, timings[tryCount+1])
+			resp.Body.Close()
+			retries.Inc("rate_limit")
+			log.Println("rate limited by server, retrying in", wait)
+			time.Sleep(wait)
+			continue
+		}
+		break
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	defer resp.Body.Close()
+	resBody, err := readBody(resp)
 	if err != nil {
-		var opError *net.OpError
-		if errors.As(err, &opError) && opError.Op == "dial" {
-			metricsJobs := make(chan models.Metrics)
-			for _, m := range metrics {
-				metricsJobs <- m
-			}
-			close(metricsJobs)
-			go sendRequest(metricsJobs, serverAddr, tryCount+1, h)
+		return 0, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusMultiStatus:
+		var result models.BatchResult
+		if err := json.Unmarshal(resBody, &result); err != nil {
+			return 0, err
 		}
-		return
+
+		for _, rm := range result.Rejected {
+			log.Printf("metric #%d %q rejected: %s", rm.Index, rm.ID, rm.Reason)
+		}
+		return len(result.Rejected), nil
+	case resp.StatusCode >= http.StatusBadRequest:
+		return 0, fmt.Errorf("server responded %s: %s", resp.Status, strings.TrimSpace(string(resBody)))
+	}
+
+	return 0, nil
+}
+
+// retryAfter returns the delay requested by the server in the Retry-After
+// header, at most maxRetryAfter, or def when the header is missing or
+// malformed.
+func retryAfter(resp *http.Response, def time.Duration) time.Duration {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return def
+	}
+
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		if seconds > int(maxRetryAfter/time.Second) {
+			return maxRetryAfter
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return min(max(time.Until(t), 0), maxRetryAfter)
 	}
 
-	resBody, _ := io.ReadAll(resp.Body)
-	log.Println("Body: ", string(resBody))
-	log.Println("Status: ", resp.StatusCode)
-	log.Println("Content-Type: ", resp.Header.Get("Content-Type"))
-	log.Println("Content-Encoding: ", resp.Header.Values("Content-Encoding"))
-	resp.Body.Close()
+	return def
 }
 
-func sendMetrics(cfg *configs.ClientCfg, metricsCh *chan models.Metrics, done chan struct{}, h *hasher) {
+func readBody(resp *http.Response) ([]byte, error) {
+	if !strings.Contains(resp.Header.Get("Content-Encoding"), "gzip") {
+		return io.ReadAll(resp.Body)
+	}
+
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+func sendMetrics(cfg *configs.ClientCfg, metricsCh *chan models.Metrics, done chan struct{}, s *sender) {
 	reprotTicker := time.NewTicker(time.Duration(cfg.IntervalsCfg.ReportInterval) * time.Second)
 	metrics := make([]models.Metrics, 0)
+	workers := make(chan struct{}, cfg.IntervalsCfg.RateLimit)
 	for {
 		select {
 		case <-done:
 			return
 		case <-reprotTicker.C:
-			metricsJobs := make(chan models.Metrics, len(metrics))
+			// Retries run in the workers, this loop keeps receiving the
+			// polled metrics meanwhile.
+			if len(workers) > 0 {
+				log.Println("previous report is still being sent, skipping this one")
+				continue
+			}
+
+			self := selfMetrics.Metrics()
+			metricsJobs := make(chan models.Metrics, len(metrics)+len(self))
 			for _, metric := range metrics {
 				metricsJobs <- metric
 			}
+			for _, metric := range self {
+				metricsJobs <- metric
+			}
 			close(metricsJobs)
+			// The workers own the queued metrics now, the ones they fail
+			// to deliver are counted as dropped.
+			metrics = make([]models.Metrics, 0, len(metrics))
+			queueLength.Set(0)
 			for i := 0; i < cfg.IntervalsCfg.RateLimit; i++ {
-				sendRequest(metricsJobs, cfg.NetAddressCfg, 0, h)
+				workers <- struct{}{}
+				go func() {
+					defer func() { <-workers }()
+					s.sendRequest(metricsJobs)
+				}()
 			}
 		case metric := <-*metricsCh:
 			metrics = append(metrics, metric)
+			queueLength.Set(float64(len(metrics)))
 		}
 	}
 }
@@ -151,9 +346,16 @@ func main() {
 	metricsStorage := agent.NewMetricsStorage()
 	metricsStorage.InitMetrics()
 	metricsCh := make(chan models.Metrics)
-	h := NewHasher(cfg.IntervalsCfg.HashKey)
+	s, err := newSender(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.IntervalsCfg.MetricsAddress != "" {
+		go serveSelfMetrics(cfg.IntervalsCfg.MetricsAddress, done)
+	}
 
-	go sendMetrics(cfg, &metricsCh, done, h)
+	go sendMetrics(cfg, &metricsCh, done, s)
 
 	go func(done chan struct{}) {
 		pollTicker := time.NewTicker(time.Duration(cfg.IntervalsCfg.PollInterval) * time.Second)
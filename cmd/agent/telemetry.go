@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/vladkonst/metrics-alerting/internal/telemetry"
+)
+
+// selfMetrics are reported to the server with every batch as agent_*
+// gauges.
+var selfMetrics = telemetry.NewRegistry("agent")
+
+var (
+	batchesSent = selfMetrics.Counter("batches_sent_total", "Batches accepted by the server.")
+	sendErrors  = selfMetrics.Counter("send_errors_total", "Batches that could not be delivered.")
+	retries     = selfMetrics.Counter("retries_total", "Resent requests by reason.", "reason")
+	dropped     = selfMetrics.Counter("dropped_metrics_total",
+		"Metrics lost in undelivered batches or rejected by the server.")
+	batchSize = selfMetrics.Histogram("batch_size", "Metrics per batch.",
+		[]float64{1, 5, 10, 25, 50, 100, 250, 500, 1000})
+	sendDuration = selfMetrics.Histogram("send_duration_seconds", "Latency of a single send request.",
+		telemetry.DurationBuckets)
+	queueLength = selfMetrics.Gauge("queue_length", "Metrics waiting for the next report.")
+)
+
+// serveSelfMetrics serves the agent's own metrics at /metrics until done is
+// closed.
+func serveSelfMetrics(addr string, done chan struct{}) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", selfMetrics.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Println("can't serve agent metrics:", err)
+	}
+}
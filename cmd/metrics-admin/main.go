@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+const usage = `usage: metrics-admin <command> [flags]
+
+commands:
+  migrate -from URI -to URI   copy all metrics between storages
+
+storage URIs:
+  file:PATH          metrics snapshot written by the server
+  embedded:PATH      embedded storage database
+  postgres://...     Postgres database`
+
+var commands = map[string]func([]string) error{
+	"migrate": runMigrate,
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+	return cmd(args[1:])
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"github.com/vladkonst/metrics-alerting/internal/storage"
+)
+
+// runMigrate copies every series from one storage to another and reads
+// them back from the destination to verify the copy. Only the destination
+// is migrated to the latest schema, and not on a dry run.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "", "source storage URI")
+	to := fs.String("to", "", "destination storage URI")
+	dryRun := fs.Bool("dry-run", false, "only report what would be copied, without writing or migrating the destination")
+	batch := fs.Int("batch", 500, "series written per request to the destination")
+	fs.Parse(args)
+	if *from == "" || *to == "" {
+		return errors.New("both -from and -to are required")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	src, srcCloser, err := storage.Open(ctx, *from, storage.OpenOptions{SkipMigrations: true})
+	if err != nil {
+		return fmt.Errorf("open source: %w", err)
+	}
+	defer srcCloser.Close()
+
+	dst, dstCloser, err := storage.Open(ctx, *to, storage.OpenOptions{SkipMigrations: *dryRun})
+	if err != nil {
+		return fmt.Errorf("open destination: %w", err)
+	}
+
+	report, err := storage.Copy(ctx, src, dst, storage.CopyOptions{
+		BatchSize: *batch,
+		DryRun:    *dryRun,
+		Progress: func(done int) {
+			fmt.Fprintf(os.Stderr, "\r%d series", done)
+		},
+	})
+	fmt.Fprintln(os.Stderr)
+	if closeErr := dstCloser.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("close destination: %w", closeErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("series: %d, created: %d, updated: %d, unchanged: %d\n", report.Total, report.Created, report.Updated, report.Unchanged)
+	if *dryRun {
+		fmt.Println("dry run, nothing was written")
+		return nil
+	}
+
+	fmt.Printf("verified: %d\n", report.Verified)
+	if len(report.Mismatched) > 0 {
+		return fmt.Errorf("%d series differ after the copy, first: %s", len(report.Mismatched), report.Mismatched[0])
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/vladkonst/metrics-alerting/internal/encryption"
+)
+
+// runKeygen writes a new RSA key pair: the private key for the server
+// -crypto-key option and the public key for the agents.
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	bits := fs.Int("bits", 4096, "RSA key size in bits")
+	privPath := fs.String("private", "private.pem", "private key output file")
+	pubPath := fs.String("public", "public.pem", "public key output file")
+	fs.Parse(args)
+
+	privPEM, pubPEM, err := encryption.GenerateKey(*bits)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(*privPath, privPEM, 0600); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(*pubPath, pubPEM, 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("private key written to %s, public key written to %s\n", *privPath, *pubPath)
+	return nil
+}
@@ -6,13 +6,26 @@ import (
 	"os/signal"
 	"syscall"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
-
 	"github.com/vladkonst/metrics-alerting/app"
 	"github.com/vladkonst/metrics-alerting/internal/configs"
 )
 
+var subcommands = map[string]func([]string) error{
+	"keygen":  runKeygen,
+	"migrate": runMigrate,
+	"token":   runToken,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	done := make(chan bool)
 	go func() {
 		c := make(chan os.Signal, 1)
@@ -27,5 +40,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	app.Run()
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/vladkonst/metrics-alerting/internal/migrations"
+)
+
+const migrateUsage = `usage: server migrate <command> [flags]
+
+commands:
+  up                apply pending migrations
+  down [-steps N]   revert the last N migrations, 1 by default
+  status            list migrations and when they were applied`
+
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	cmd := args[0]
+	fs := flag.NewFlagSet("migrate "+cmd, flag.ExitOnError)
+	dsn := fs.String("d", os.Getenv("DATABASE_DSN"), "database connection string")
+	steps := fs.Int("steps", 1, "number of migrations to revert")
+	fs.Parse(args[1:])
+	if *dsn == "" {
+		return errors.New("database connection string is required")
+	}
+
+	conn, err := pgxpool.New(context.Background(), *dsn)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	switch cmd {
+	case "up":
+		n, err := migrations.Up(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("applied %d migrations\n", n)
+		return nil
+	case "down":
+		n, err := migrations.Down(ctx, conn, *steps)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("reverted %d migrations\n", n)
+		return nil
+	case "status":
+		statuses, err := migrations.GetStatus(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	default:
+		return errors.New(migrateUsage)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/vladkonst/metrics-alerting/internal/migrations"
+	"github.com/vladkonst/metrics-alerting/internal/tokens"
+)
+
+const tokenUsage = `usage: server token <command> [flags]
+
+commands:
+  issue -name NAME -scopes read,write,admin   create a token and print its secret
+  revoke -id ID                                revoke a token
+  list                                         list tokens`
+
+// runToken manages API tokens in the same store the server uses: the
+// database when -d or DATABASE_DSN is set, the tokens file otherwise.
+func runToken(args []string) error {
+	if len(args) == 0 {
+		return errors.New(tokenUsage)
+	}
+
+	cmd := args[0]
+	fs := flag.NewFlagSet("token "+cmd, flag.ExitOnError)
+	dsn := fs.String("d", os.Getenv("DATABASE_DSN"), "database connection string")
+	file := fs.String("tokens-file", envOr("TOKENS_FILE", "tokens.json"), "file with API tokens when no database is configured")
+	name := fs.String("name", "", "token name, used as the client identity")
+	scopes := fs.String("scopes", string(tokens.ScopeWrite), "comma separated scopes: read, write, admin")
+	id := fs.String("id", "", "token id")
+	fs.Parse(args[1:])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var store tokens.Store = tokens.NewFileStore(*file)
+	if *dsn != "" {
+		conn, err := pgxpool.New(context.Background(), *dsn)
+		if err != nil {
+			return err
+		}
+
+		defer conn.Close()
+		if _, err := migrations.Up(ctx, conn); err != nil {
+			return err
+		}
+		store = tokens.NewPGStore(conn)
+	}
+
+	switch cmd {
+	case "issue":
+		if *name == "" {
+			return errors.New("token name is required")
+		}
+
+		sc, err := tokens.ParseScopes(*scopes)
+		if err != nil {
+			return err
+		}
+
+		secret, t, err := tokens.Issue(ctx, store, *name, sc)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("id: %s\nsecret: %s\n", t.ID, secret)
+		return nil
+	case "revoke":
+		if *id == "" {
+			return errors.New("token id is required")
+		}
+
+		return store.Revoke(ctx, *id)
+	case "list":
+		list, err := store.List(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED\tREVOKED")
+		for _, t := range list {
+			scopes := make([]string, 0, len(t.Scopes))
+			for _, sc := range t.Scopes {
+				scopes = append(scopes, string(sc))
+			}
+			revoked := "-"
+			if t.RevokedAt != nil {
+				revoked = t.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.Name, strings.Join(scopes, ","), t.CreatedAt.Format(time.RFC3339), revoked)
+		}
+		return w.Flush()
+	default:
+		return errors.New(tokenUsage)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+
+	return def
+}
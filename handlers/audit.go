@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/vladkonst/metrics-alerting/internal/audit"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+)
+
+func copyMetric(m *models.Metrics) *models.Metrics {
+	c := *m
+	if m.Delta != nil {
+		d := *m.Delta
+		c.Delta = &d
+	}
+	if m.Value != nil {
+		v := *m.Value
+		c.Value = &v
+	}
+	return &c
+}
+
+func metricKey(m *models.Metrics) string {
+	return m.MType + ":" + m.ID
+}
+
+// previousValues derives what a write replaced from its result, for
+// storages that can't report it. Counters held their stored total minus the
+// delta, a zero total is taken for a new series. Previous gauge values are
+// unknown and left out.
+func previousValues(metrics, stored []models.Metrics) map[string]*models.Metrics {
+	previous := make(map[string]*models.Metrics, len(metrics))
+	for i, m := range metrics {
+		k := metricKey(&m)
+		if _, ok := previous[k]; ok || m.MType != "counter" {
+			continue
+		}
+
+		var prev *models.Metrics
+		if d := *stored[i].Delta - *m.Delta; d != 0 {
+			prev = &models.Metrics{ID: m.ID, MType: m.MType, Delta: &d}
+		}
+		previous[k] = prev
+	}
+
+	return previous
+}
+
+func (sp *StorageProvider) audit(r *http.Request, action string, old map[string]*models.Metrics, stored []models.Metrics) {
+	if sp.Auditor == nil {
+		return
+	}
+
+	changes := make([]audit.Change, 0, len(stored))
+	for _, m := range stored {
+		k := metricKey(&m)
+		changes = append(changes, audit.Change{ID: m.ID, Type: m.MType, Old: old[k], New: copyMetric(&m)})
+		old[k] = copyMetric(&m)
+	}
+
+	sp.Auditor.Record(audit.Event{
+		Action:   action,
+		Identity: Identity(r.Context()),
+		IP:       RemoteIP(r),
+		Changes:  changes,
+	})
+}
@@ -0,0 +1,88 @@
+package handlers_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/internal/audit"
+	"github.com/vladkonst/metrics-alerting/internal/configs"
+)
+
+func TestAudit(t *testing.T) {
+	received := make(chan audit.Event, 10)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e audit.Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err == nil {
+			received <- e
+		}
+	}))
+	defer sink.Close()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	ts, _ := newTestServer(t, &configs.ServerIntervalsCfg{AuditFile: path, AuditURL: sink.URL, AuditBuffer: 10})
+
+	res := testRequest(t, ts, "POST", "/update/counter/audited/2", nil)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	req, err := http.NewRequest("POST", ts.URL+"/updates/", bytes.NewBufferString(`[{"id": "audited", "type": "counter", "delta": 3}, {"id": "g", "type": "gauge", "value": 1.5}]`))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	res = testRequest(t, ts, "POST", "/update/gauge/g/2.5", nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	events := make([]audit.Event, 0, 3)
+	for len(events) < 3 {
+		select {
+		case e := <-received:
+			events = append(events, e)
+		case <-time.After(5 * time.Second):
+			t.Fatal("audit events were not delivered")
+		}
+	}
+
+	assert.Equal(t, audit.ActionUpdate, events[0].Action)
+	assert.Equal(t, "127.0.0.1", events[0].IP)
+	require.Len(t, events[0].Changes, 1)
+	assert.Nil(t, events[0].Changes[0].Old)
+	assert.Equal(t, int64(2), *events[0].Changes[0].New.Delta)
+
+	assert.Equal(t, audit.ActionBatchUpdate, events[1].Action)
+	assert.Equal(t, []string{"audited", "g"}, events[1].Metrics)
+	require.Len(t, events[1].Changes, 2)
+	assert.Equal(t, int64(2), *events[1].Changes[0].Old.Delta)
+	assert.Equal(t, int64(5), *events[1].Changes[0].New.Delta)
+	assert.Nil(t, events[1].Changes[1].Old)
+
+	require.Len(t, events[2].Changes, 1)
+	assert.Equal(t, 1.5, *events[2].Changes[0].Old.Value)
+	assert.Equal(t, 2.5, *events[2].Changes[0].New.Value)
+
+	assert.Eventually(t, func() bool {
+		f, err := os.Open(path)
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+		lines := 0
+		for sc := bufio.NewScanner(f); sc.Scan(); {
+			lines++
+		}
+		return lines == 3
+	}, 5*time.Second, 10*time.Millisecond)
+}
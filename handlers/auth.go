@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/vladkonst/metrics-alerting/internal/logger"
+	"github.com/vladkonst/metrics-alerting/internal/tokens"
+)
+
+type Authenticator struct {
+	store tokens.Store
+}
+
+func NewAuthenticator(store tokens.Store) *Authenticator {
+	return &Authenticator{store: store}
+}
+
+// Require rejects requests without a bearer token granting the scope and
+// uses the token name as the client identity.
+func (a *Authenticator) Require(scope tokens.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || secret == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				reject(RejectUnauthorized)
+				http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+				return
+			}
+
+			t, err := tokens.Authenticate(r.Context(), a.store, strings.TrimSpace(secret))
+			if err != nil {
+				if !errors.Is(err, tokens.ErrNotFound) && !errors.Is(err, tokens.ErrRevoked) {
+					log := logger.Get()
+					log.Error().Err(err).Msg("failed to look up API token")
+					http.Error(w, "Internal server error.", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics", error="invalid_token"`)
+				reject(RejectUnauthorized)
+				http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+				return
+			}
+
+			if !t.Allows(scope) {
+				reject(RejectForbidden)
+				http.Error(w, "Forbidden.", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), t.Name)))
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package handlers_test
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/internal/configs"
+	"github.com/vladkonst/metrics-alerting/internal/tokens"
+)
+
+func TestTokenAuth(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	store := tokens.NewFileStore(path)
+	reader, _, err := tokens.Issue(ctx, store, "dashboard", []tokens.Scope{tokens.ScopeRead})
+	require.NoError(t, err)
+	writer, _, err := tokens.Issue(ctx, store, "agent", []tokens.Scope{tokens.ScopeWrite})
+	require.NoError(t, err)
+	admin, _, err := tokens.Issue(ctx, store, "ops", []tokens.Scope{tokens.ScopeAdmin})
+	require.NoError(t, err)
+	revoked, rt, err := tokens.Issue(ctx, store, "old", []tokens.Scope{tokens.ScopeWrite})
+	require.NoError(t, err)
+	require.NoError(t, store.Revoke(ctx, rt.ID))
+
+	ts, _ := newTestServer(t, &configs.ServerIntervalsCfg{AuthEnabled: true, TokensFile: path})
+	tests := []struct {
+		name       string
+		method     string
+		request    string
+		token      string
+		statusCode int
+	}{
+		{name: "no token read test", method: "GET", request: "/value/gauge/auth", statusCode: 401},
+		{name: "no token write test", method: "POST", request: "/update/gauge/auth/1", statusCode: 401},
+		{name: "unknown token test", method: "POST", request: "/update/gauge/auth/1", token: "mt_unknown", statusCode: 401},
+		{name: "revoked token test", method: "POST", request: "/update/gauge/auth/1", token: revoked, statusCode: 401},
+		{name: "read token write test", method: "POST", request: "/update/gauge/auth/1", token: reader, statusCode: 403},
+		{name: "write token write test", method: "POST", request: "/update/gauge/auth/1", token: writer, statusCode: 200},
+		{name: "write token read test", method: "GET", request: "/value/gauge/auth", token: writer, statusCode: 403},
+		{name: "read token read test", method: "GET", request: "/value/gauge/auth", token: reader, statusCode: 200},
+		{name: "admin token write test", method: "POST", request: "/update/gauge/auth/2", token: admin, statusCode: 200},
+		{name: "admin token read test", method: "GET", request: "/", token: admin, statusCode: 200},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, ts.URL+test.request, nil)
+			require.NoError(t, err)
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, test.statusCode, resp.StatusCode)
+		})
+	}
+}
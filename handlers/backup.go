@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/vladkonst/metrics-alerting/internal/audit"
+	"github.com/vladkonst/metrics-alerting/internal/logger"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+)
+
+// A backup is a gzip compressed stream of JSON lines. The first line is the
+// header and every following line holds one series in the /update/ format,
+// sorted by type and name:
+//
+//	{"format":"metrics-backup","version":1,"created_at":"2024-05-01T10:00:00Z","gauges":1,"counters":1}
+//	{"id":"PollCount","type":"counter","delta":42}
+//	{"id":"Alloc","type":"gauge","value":1.5}
+//
+// The header counts let a restore detect a truncated backup.
+const (
+	BackupFormat  = "metrics-backup"
+	BackupVersion = 1
+
+	RestoreMerge   = "merge"
+	RestoreReplace = "replace"
+
+	backupTimeout = 30 * time.Second
+)
+
+type BackupHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Gauges    int       `json:"gauges"`
+	Counters  int       `json:"counters"`
+}
+
+type RestoreResult struct {
+	Mode string `json:"mode"`
+	// Series is the number of series in the backup, Changed the number of
+	// them that had a different value and Removed the number of series
+	// dropped by a replace.
+	Series  int `json:"series"`
+	Changed int `json:"changed"`
+	Removed int `json:"removed"`
+}
+
+// snapshotMetrics reads every series, at a single point in time when the
+// storage supports it, sorted by type and name.
+func snapshotMetrics(ctx context.Context, s MetricRepository) ([]models.Metrics, error) {
+	var metrics []models.Metrics
+	var err error = errors.ErrUnsupported
+	if ss, ok := s.(Snapshotter); ok {
+		metrics, err = ss.Snapshot(ctx)
+	}
+
+	if errors.Is(err, errors.ErrUnsupported) {
+		gauges, err := s.GetGaugesValues(ctx)
+		if err != nil {
+			return nil, err
+		}
+		counters, err := s.GetCountersValues(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		metrics = make([]models.Metrics, 0, len(gauges)+len(counters))
+		for id, v := range gauges {
+			metrics = append(metrics, models.Metrics{ID: id, MType: "gauge", Value: &v})
+		}
+		for id, d := range counters {
+			metrics = append(metrics, models.Metrics{ID: id, MType: "counter", Delta: &d})
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metricKey(&metrics[i]) < metricKey(&metrics[j])
+	})
+	return metrics, nil
+}
+
+// WriteBackup writes the metrics in the backup format.
+func WriteBackup(w io.Writer, metrics []models.Metrics, created time.Time) error {
+	header := BackupHeader{Format: BackupFormat, Version: BackupVersion, CreatedAt: created.UTC()}
+	for _, m := range metrics {
+		if m.MType == "counter" {
+			header.Counters++
+		} else {
+			header.Gauges++
+		}
+	}
+
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+
+	for _, m := range metrics {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// ReadBackup reads and validates a backup. Uncompressed backups are
+// accepted as well.
+func ReadBackup(r io.Reader) (*BackupHeader, []models.Metrics, error) {
+	br := bufio.NewReader(r)
+	var src io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer zr.Close()
+		src = zr
+	}
+
+	dec := json.NewDecoder(src)
+	var header BackupHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, nil, fmt.Errorf("invalid backup header: %w", err)
+	}
+
+	if header.Format != BackupFormat {
+		return nil, nil, errors.New("not a metrics backup")
+	}
+
+	if header.Version < 1 || header.Version > BackupVersion {
+		return nil, nil, fmt.Errorf("unsupported backup version %d", header.Version)
+	}
+
+	metrics := make([]models.Metrics, 0, header.Gauges+header.Counters)
+	gauges, counters := 0, 0
+	for {
+		var m models.Metrics
+		err := dec.Decode(&m)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid series %d: %w", len(metrics)+1, err)
+		}
+
+		if err := m.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("invalid series %d: %w", len(metrics)+1, err)
+		}
+
+		if m.MType == "counter" {
+			counters++
+		} else {
+			gauges++
+		}
+		metrics = append(metrics, m)
+	}
+
+	if gauges != header.Gauges || counters != header.Counters {
+		return nil, nil, fmt.Errorf("backup is truncated: got %d gauges and %d counters, expected %d and %d",
+			gauges, counters, header.Gauges, header.Counters)
+	}
+
+	return &header, metrics, nil
+}
+
+// Backup streams every series in the backup format.
+func (sp *StorageProvider) Backup(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), backupTimeout)
+	defer cancel()
+	metrics, err := snapshotMetrics(ctx, sp.Storage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="metrics-%s.jsonl.gz"`, now.Format("20060102T150405Z")))
+	if err := WriteBackup(w, metrics, now); err != nil {
+		log := logger.Get()
+		log.Error().Err(err).Msg("failed to write backup")
+	}
+}
+
+// Restore loads a backup. In merge mode the series from the backup take
+// their backed up values and the others are kept, in replace mode all other
+// series are removed in the same storage operation, which needs a Replacer.
+// Writes arriving during a restore may be overwritten.
+func (sp *StorageProvider) Restore(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = RestoreMerge
+	}
+	if mode != RestoreMerge && mode != RestoreReplace {
+		http.Error(w, fmt.Sprintf("unknown restore mode %q", mode), http.StatusBadRequest)
+		return
+	}
+
+	_, metrics, err := ReadBackup(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if sp.Health != nil {
+		state := sp.Health.State()
+		if state == StateRestoring || state == StateDraining || !sp.Health.Transition(state, StateRestoring) {
+			http.Error(w, "server is "+sp.Health.State(), http.StatusServiceUnavailable)
+			return
+		}
+		defer sp.Health.Transition(StateRestoring, state)
+	}
+
+	var replacer Replacer
+	if mode == RestoreReplace {
+		var ok bool
+		if replacer, ok = sp.Storage.(Replacer); !ok {
+			http.Error(w, "storage does not support replacing all series", http.StatusNotImplemented)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), backupTimeout)
+	defer cancel()
+	current, err := snapshotMetrics(ctx, sp.Storage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	old := make(map[string]*models.Metrics, len(current))
+	for _, m := range current {
+		old[metricKey(&m)] = copyMetric(&m)
+	}
+
+	result := RestoreResult{Mode: mode, Series: len(metrics)}
+	base := old
+	if mode == RestoreReplace {
+		base = make(map[string]*models.Metrics)
+		for _, m := range metrics {
+			delete(old, metricKey(&m))
+		}
+		result.Removed = len(old)
+	}
+
+	writes := restoreWrites(metrics, base)
+	result.Changed = len(writes)
+	stored := make([]models.Metrics, 0)
+	if replacer != nil {
+		stored, err = sp.replace(ctx, replacer, writes, current)
+	} else if len(writes) > 0 {
+		stored, _, err = sp.write(ctx, writes)
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errors.ErrUnsupported) {
+			status = http.StatusNotImplemented
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if sp.Cardinality != nil {
+		for _, m := range metrics {
+			sp.Cardinality.Seed("", m.MType, m.ID)
+		}
+	}
+
+	sp.audit(r, audit.ActionRestore, base, stored)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sp.publish(stored...)
+}
+
+// replace makes the metrics the only series. The journal is replaced first
+// and put back to current when the storage fails, so neither of them ends up
+// without the old series and the restored ones.
+func (sp *StorageProvider) replace(ctx context.Context, replacer Replacer, metrics, current []models.Metrics) ([]models.Metrics, error) {
+	defer sp.lockSeries(nil)()
+	if sp.Persistence != nil {
+		if err := sp.Persistence.Replace(ctx, metrics); err != nil {
+			return nil, err
+		}
+	}
+
+	stored, err := replacer.ReplaceMetrics(ctx, metrics)
+	if err != nil {
+		if sp.Persistence != nil {
+			if jerr := sp.Persistence.Replace(ctx, current); jerr != nil {
+				err = errors.Join(err, jerr)
+			}
+		}
+		return nil, err
+	}
+
+	if sp.Cardinality != nil {
+		sp.Cardinality.Reset()
+	}
+	return stored, nil
+}
+
+// restoreWrites returns the updates turning the current values into the
+// backed up ones. Counters are written as the difference to the current
+// value.
+func restoreWrites(metrics []models.Metrics, current map[string]*models.Metrics) []models.Metrics {
+	writes := make([]models.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		cur, ok := current[metricKey(&m)]
+		switch m.MType {
+		case "counter":
+			d := *m.Delta
+			if ok {
+				d -= *cur.Delta
+			}
+			if ok && d == 0 {
+				continue
+			}
+			writes = append(writes, models.Metrics{ID: m.ID, MType: m.MType, Delta: &d})
+		case "gauge":
+			if ok && *cur.Value == *m.Value {
+				continue
+			}
+			writes = append(writes, *copyMetric(&m))
+		}
+	}
+
+	return writes
+}
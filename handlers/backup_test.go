@@ -0,0 +1,237 @@
+package handlers_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/app"
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/configs"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+)
+
+func newBackupServer(t *testing.T, metrics ...models.Metrics) (*httptest.Server, *app.App) {
+	ts, aa := newTestServer(t, &configs.ServerIntervalsCfg{})
+	if len(metrics) > 0 {
+		_, err := aa.Storage.AddMetrics(context.Background(), metrics)
+		require.NoError(t, err)
+	}
+	return ts, aa
+}
+
+// backupRequest leaves the response body open for reading.
+func backupRequest(t *testing.T, ts *httptest.Server, method, path string, body io.Reader) *http.Response {
+	req, err := http.NewRequest(method, ts.URL+path, body)
+	require.NoError(t, err)
+
+	res, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	return res
+}
+
+func counter(id string, d int64) models.Metrics {
+	return models.Metrics{ID: id, MType: "counter", Delta: &d}
+}
+
+func gauge(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+func TestBackup(t *testing.T) {
+	ts, _ := newBackupServer(t, gauge("Alloc", 1.5), counter("PollCount", 42))
+	res := backupRequest(t, ts, http.MethodGet, "/admin/backup", nil)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/gzip", res.Header.Get("Content-Type"))
+
+	zr, err := gzip.NewReader(res.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(zr)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	require.Len(t, lines, 3)
+
+	var header handlers.BackupHeader
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &header))
+	assert.Equal(t, handlers.BackupFormat, header.Format)
+	assert.Equal(t, handlers.BackupVersion, header.Version)
+	assert.Equal(t, 1, header.Gauges)
+	assert.Equal(t, 1, header.Counters)
+	assert.WithinDuration(t, time.Now(), header.CreatedAt, time.Minute)
+	assert.JSONEq(t, `{"id":"PollCount","type":"counter","delta":42}`, lines[1])
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge","value":1.5}`, lines[2])
+}
+
+func TestRestore(t *testing.T) {
+	var backup bytes.Buffer
+	require.NoError(t, handlers.WriteBackup(&backup, []models.Metrics{counter("c", 4), gauge("g", 2)}, time.Now()))
+
+	tests := []struct {
+		name     string
+		query    string
+		body     []byte
+		status   int
+		result   handlers.RestoreResult
+		counters map[string]int64
+		gauges   map[string]float64
+	}{
+		{
+			name:     "merge test",
+			body:     backup.Bytes(),
+			status:   http.StatusOK,
+			result:   handlers.RestoreResult{Mode: handlers.RestoreMerge, Series: 2, Changed: 2},
+			counters: map[string]int64{"c": 4, "kept": 1},
+			gauges:   map[string]float64{"g": 2},
+		},
+		{
+			name:     "replace test",
+			query:    "?mode=replace",
+			body:     backup.Bytes(),
+			status:   http.StatusOK,
+			result:   handlers.RestoreResult{Mode: handlers.RestoreReplace, Series: 2, Changed: 2, Removed: 1},
+			counters: map[string]int64{"c": 4},
+			gauges:   map[string]float64{"g": 2},
+		},
+		{
+			name:     "uncompressed test",
+			body:     []byte("{\"format\":\"metrics-backup\",\"version\":1,\"counters\":1}\n{\"id\":\"c\",\"type\":\"counter\",\"delta\":10}\n"),
+			status:   http.StatusOK,
+			result:   handlers.RestoreResult{Mode: handlers.RestoreMerge, Series: 1, Changed: 1},
+			counters: map[string]int64{"c": 10, "kept": 1},
+			gauges:   map[string]float64{"g": 1},
+		},
+		{
+			name:   "unknown mode test",
+			query:  "?mode=append",
+			body:   backup.Bytes(),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "truncated test",
+			body:   []byte("{\"format\":\"metrics-backup\",\"version\":1,\"gauges\":2}\n{\"id\":\"g\",\"type\":\"gauge\",\"value\":1}\n"),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "newer version test",
+			body:   []byte("{\"format\":\"metrics-backup\",\"version\":2}\n"),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "invalid series test",
+			body:   []byte("{\"format\":\"metrics-backup\",\"version\":1,\"gauges\":1}\n{\"id\":\"g\",\"type\":\"gauge\"}\n"),
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts, aa := newBackupServer(t, counter("c", 7), counter("kept", 1), gauge("g", 1))
+			res := backupRequest(t, ts, http.MethodPost, "/admin/restore"+test.query, bytes.NewReader(test.body))
+			defer res.Body.Close()
+			require.Equal(t, test.status, res.StatusCode)
+			if test.status != http.StatusOK {
+				return
+			}
+
+			var result handlers.RestoreResult
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&result))
+			assert.Equal(t, test.result, result)
+
+			counters, err := aa.Storage.GetCountersValues(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, test.counters, counters)
+			gauges, err := aa.Storage.GetGaugesValues(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, test.gauges, gauges)
+		})
+	}
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	src, _ := newBackupServer(t, gauge("g", -0.25), counter("c", 9))
+	res := backupRequest(t, src, http.MethodGet, "/admin/backup", nil)
+	backup, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+
+	dst, aa := newBackupServer(t, counter("stale", 3))
+	res = backupRequest(t, dst, http.MethodPost, "/admin/restore?mode=replace", bytes.NewReader(backup))
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	counters, err := aa.Storage.GetCountersValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"c": 9}, counters)
+	gauges, err := aa.Storage.GetGaugesValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"g": -0.25}, gauges)
+}
+
+// failingReplacer fails every replace of all series.
+type failingReplacer struct {
+	handlers.MetricRepository
+}
+
+func (failingReplacer) ReplaceMetrics(context.Context, []models.Metrics) ([]models.Metrics, error) {
+	return nil, errors.New("disk full")
+}
+
+// recordingJournal keeps the last appended value of every series and the
+// series of every replace.
+type recordingJournal struct {
+	mu       sync.Mutex
+	last     map[string]models.Metrics
+	replaced [][]models.Metrics
+}
+
+func (j *recordingJournal) Append(ctx context.Context, metrics ...models.Metrics) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.last == nil {
+		j.last = make(map[string]models.Metrics)
+	}
+	for _, m := range metrics {
+		j.last[m.MType+":"+m.ID] = m
+	}
+	return nil
+}
+
+func (j *recordingJournal) Replace(ctx context.Context, metrics []models.Metrics) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.replaced = append(j.replaced, metrics)
+	return nil
+}
+
+func TestRestoreReplaceFailure(t *testing.T) {
+	var backup bytes.Buffer
+	require.NoError(t, handlers.WriteBackup(&backup, []models.Metrics{counter("c", 4)}, time.Now()))
+	ts, aa := newBackupServer(t, counter("kept", 1))
+	journal := &recordingJournal{}
+	aa.StorageProvider.Persistence = journal
+	aa.StorageProvider.Storage = failingReplacer{aa.Storage}
+
+	res := backupRequest(t, ts, http.MethodPost, "/admin/restore?mode=replace", bytes.NewReader(backup.Bytes()))
+	res.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, res.StatusCode)
+
+	counters, err := aa.Storage.GetCountersValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"kept": 1}, counters)
+	require.Len(t, journal.replaced, 2, "the journal is written before the storage and put back after it failed")
+	assert.Equal(t, []models.Metrics{counter("c", 4)}, journal.replaced[0])
+	assert.Equal(t, []models.Metrics{counter("kept", 1)}, journal.replaced[1])
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/vladkonst/metrics-alerting/internal/encryption"
+)
+
+// EncryptionHeader marks request bodies encrypted with encryption.Encrypt.
+const (
+	EncryptionHeader = "X-Encryption"
+	EncryptionScheme = "rsa-oaep-aes256gcm"
+)
+
+// DecryptMiddleware decrypts request bodies with the server private key. Once
+// a key is configured POST requests with a plain body are rejected.
+func DecryptMiddleware(priv *rsa.PrivateKey) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scheme := r.Header.Get(EncryptionHeader)
+			if scheme == "" {
+				if r.Method == http.MethodPost && r.ContentLength != 0 {
+					reject(RejectEncryption)
+					http.Error(w, "request body must be encrypted", http.StatusBadRequest)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if scheme != EncryptionScheme {
+				reject(RejectEncryption)
+				http.Error(w, "unsupported encryption scheme", http.StatusBadRequest)
+				return
+			}
+
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "error reading body", http.StatusInternalServerError)
+				return
+			}
+
+			r.Body.Close()
+			plain, err := encryption.Decrypt(priv, b)
+			if err != nil {
+				reject(RejectEncryption)
+				http.Error(w, "can't decrypt request body", http.StatusBadRequest)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(plain))
+			r.ContentLength = int64(len(plain))
+			r.Header.Set("Content-Length", strconv.Itoa(len(plain)))
+			r.Header.Del(EncryptionHeader)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package handlers_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/internal/configs"
+	"github.com/vladkonst/metrics-alerting/internal/encryption"
+)
+
+func TestDecryptMiddleware(t *testing.T) {
+	privPEM, pubPEM, err := encryption.GenerateKey(2048)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	privPath, pubPath := filepath.Join(dir, "private.pem"), filepath.Join(dir, "public.pem")
+	require.NoError(t, os.WriteFile(privPath, privPEM, 0600))
+	require.NoError(t, os.WriteFile(pubPath, pubPEM, 0644))
+	pub, err := encryption.LoadPublicKey(pubPath)
+	require.NoError(t, err)
+
+	ts, _ := newTestServer(t, &configs.ServerIntervalsCfg{CryptoKey: privPath})
+
+	buff := bytes.NewBuffer(nil)
+	zb := gzip.NewWriter(buff)
+	_, err = zb.Write([]byte(`[{"id": "encrypted", "type": "gauge", "value": 1.1}]`))
+	require.NoError(t, err)
+	require.NoError(t, zb.Close())
+	encrypted, err := encryption.Encrypt(pub, buff.Bytes())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		body       []byte
+		encrypted  bool
+		statusCode int
+	}{
+		{
+			name:       "encrypted body test",
+			body:       encrypted,
+			encrypted:  true,
+			statusCode: 200,
+		},
+		{
+			name:       "plain body test",
+			body:       buff.Bytes(),
+			statusCode: 400,
+		},
+		{
+			name:       "corrupted body test",
+			body:       encrypted[:len(encrypted)-1],
+			encrypted:  true,
+			statusCode: 400,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", ts.URL+"/updates", bytes.NewReader(test.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Content-Encoding", "gzip")
+			if test.encrypted {
+				req.Header.Set("X-Encryption", "rsa-oaep-aes256gcm")
+			}
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, test.statusCode, resp.StatusCode)
+		})
+	}
+
+	res := testRequest(t, ts, "GET", "/value/gauge/encrypted", nil)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
@@ -3,70 +3,185 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash"
+	"hash/fnv"
 	"html/template"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 
+	"github.com/vladkonst/metrics-alerting/internal/audit"
+	"github.com/vladkonst/metrics-alerting/internal/cardinality"
 	"github.com/vladkonst/metrics-alerting/internal/logger"
 	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/pgretry"
+	"github.com/vladkonst/metrics-alerting/internal/signing"
 )
 
+// HashHeader carries the hex encoded HMAC-SHA256 of a request or response body.
+const HashHeader = "HashSHA256"
+
 type Hasher struct {
-	hash hash.Hash
+	key   []byte
+	guard *ReplayGuard
 }
 
-func NewHasher(key string) *Hasher {
+// NewHasher returns nil when no key is configured. A non-nil guard makes
+// the timestamp and nonce headers mandatory for signed requests.
+func NewHasher(key string, guard *ReplayGuard) *Hasher {
 	if key == "" {
 		return nil
 	}
-	hash := sha256.New()
-	return &Hasher{hash}
+	return &Hasher{key: []byte(key), guard: guard}
+}
+
+func (h *Hasher) HashBody(b []byte) string {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
-func (h *Hasher) HashBody(b []byte) (string, error) {
-	_, err := h.hash.Write(b)
+// Verify reports whether sig is a valid hex encoded signature of b.
+func (h *Hasher) Verify(b []byte, sig string) bool {
+	src, err := hex.DecodeString(sig)
 	if err != nil {
-		return "", errors.New("internal server error")
+		return false
+	}
+
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write(b)
+	return hmac.Equal(src, mac.Sum(nil))
+}
+
+func (h *Hasher) verifyRequest(r *http.Request, body []byte, sig string) error {
+	ts, nonce := r.Header.Get(TimestampHeader), r.Header.Get(NonceHeader)
+	if ts == "" && nonce == "" {
+		if h.guard != nil {
+			return errors.New("missing request timestamp or nonce")
+		}
+		if !h.Verify(body, sig) {
+			return errors.New("invalid hash provided")
+		}
+		return nil
+	}
+
+	if ts == "" || nonce == "" {
+		return errors.New("missing request timestamp or nonce")
+	}
+
+	if !h.Verify(signing.Material(ts, nonce, body), sig) {
+		return errors.New("invalid hash provided")
+	}
+
+	if h.guard != nil {
+		return h.guard.Check(ts, nonce)
+	}
+
+	return nil
+}
+
+// maxSignedResponse bounds the response bodies buffered to be signed.
+const maxSignedResponse = 1 << 20
+
+// hashResponseWriter buffers the body to sign it. Gzip downloads such as
+// backups and bodies over maxSignedResponse are streamed unsigned instead.
+type hashResponseWriter struct {
+	w         http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	streaming bool
+}
+
+func (hw *hashResponseWriter) Header() http.Header {
+	return hw.w.Header()
+}
+
+func (hw *hashResponseWriter) Write(b []byte) (int, error) {
+	if !hw.streaming && (hw.body.Len()+len(b) > maxSignedResponse ||
+		strings.HasPrefix(hw.w.Header().Get("Content-Type"), "application/gzip")) {
+		hw.stream()
 	}
 
-	dst := h.hash.Sum(nil)
-	dstHex := hex.EncodeToString(dst)
-	return dstHex, nil
+	if hw.streaming {
+		return hw.w.Write(b)
+	}
+	return hw.body.Write(b)
 }
 
+func (hw *hashResponseWriter) WriteHeader(statusCode int) {
+	if hw.status == 0 {
+		hw.status = statusCode
+	}
+}
+
+// stream sends the status and the buffered body and passes the rest of the
+// body through.
+func (hw *hashResponseWriter) stream() {
+	hw.streaming = true
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	hw.w.WriteHeader(hw.status)
+	hw.w.Write(hw.body.Bytes())
+	hw.body.Reset()
+}
+
+// HashMiddleware rejects POST requests without a valid signature of their
+// body and signs the response bodies, except for the ones hashResponseWriter
+// streams.
 func (h *Hasher) HashMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		src := r.Header.Get("HashSHA256")
-		if src == "" {
-			next.ServeHTTP(w, r)
-			return
-		}
-		b, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "error reading body", http.StatusInternalServerError)
-			return
+		if r.Method == http.MethodPost {
+			src := r.Header.Get(HashHeader)
+			if src == "" {
+				reject(RejectSignature)
+				http.Error(w, "missing hash", http.StatusBadRequest)
+				return
+			}
+
+			b, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "error reading body", http.StatusInternalServerError)
+				return
+			}
+
+			r.Body.Close()
+			if err := h.verifyRequest(r, b, src); err != nil {
+				if errors.Is(err, ErrNonceCacheFull) {
+					w.Header().Set("Retry-After", "1")
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					return
+				}
+				reject(RejectSignature)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewBuffer(b))
 		}
 
-		defer r.Body.Close()
-		dst, _ := h.HashBody(b)
-		if src != dst {
-			http.Error(w, "invalid hash provided", http.StatusBadRequest)
+		hw := &hashResponseWriter{w: w}
+		next.ServeHTTP(hw, r)
+		if hw.streaming {
 			return
 		}
-		r.Body = io.NopCloser(bytes.NewBuffer(b))
-		next.ServeHTTP(w, r)
+		if hw.status == 0 {
+			hw.status = http.StatusOK
+		}
+
+		w.Header().Set(HashHeader, h.HashBody(hw.body.Bytes()))
+		w.WriteHeader(hw.status)
+		w.Write(hw.body.Bytes())
 	})
 }
 
@@ -121,20 +236,40 @@ func (lr *loggingResponseWriter) Header() http.Header {
 	return lr.r.Header()
 }
 
+// LogRequest logs every request and counts it by route pattern. The route
+// context is created here, so the pattern matched by the router is visible
+// once the request is served.
 func LogRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		logger := logger.Get()
 		lw := loggingResponseWriter{r: w}
+		rctx := chi.RouteContext(r.Context())
+		if rctx == nil {
+			rctx = chi.NewRouteContext()
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		}
 		next.ServeHTTP(&lw, r)
+		duration := time.Since(start)
 		logger.
 			Info().
 			Str("method", r.Method).
 			Str("URI", r.URL.RequestURI()).
-			Dur("duration", time.Since(start)).
+			Dur("duration", duration).
 			Int("status", lw.status).
 			Int("size", lw.size).
 			Msg("incoming request")
+
+		route := rctx.RoutePattern()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := lw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requestsTotal.Inc(route, r.Method, strconv.Itoa(status))
+		requestDuration.Observe(duration.Seconds(), route, r.Method)
 	})
 }
 
@@ -146,21 +281,259 @@ type MetricRepository interface {
 	GetCountersValues(context.Context) (map[string]int64, error)
 }
 
+const (
+	// BatchModeHeader selects how /updates/ treats invalid items. By default
+	// valid items are stored and the rest are reported back; in strict mode
+	// a single invalid item rejects the whole batch.
+	BatchModeHeader = "X-Batch-Mode"
+	BatchModeStrict = "strict"
+)
+
+// Snapshotter is implemented by storages that can read every series at a
+// single point in time. Wrappers return errors.ErrUnsupported when the
+// wrapped storage can't.
+type Snapshotter interface {
+	Snapshot(context.Context) ([]models.Metrics, error)
+}
+
+// Resetter is implemented by storages that can remove every series. Wrappers
+// return errors.ErrUnsupported like for Snapshotter.
+type Resetter interface {
+	Reset(context.Context) error
+}
+
+// Replacer is implemented by storages that can replace every series in a
+// single operation: ReplaceMetrics removes all series and stores the metrics,
+// or changes nothing when it fails. Wrappers return errors.ErrUnsupported
+// like for Snapshotter.
+type Replacer interface {
+	ReplaceMetrics(context.Context, []models.Metrics) ([]models.Metrics, error)
+}
+
+// Swapper is implemented by storages that report what a write replaced.
+// SwapMetrics stores the metrics like AddMetrics and also returns the value
+// every written series had before the batch, keyed by type and name, nil
+// for the series the batch created. Wrappers return errors.ErrUnsupported
+// like for Snapshotter.
+type Swapper interface {
+	SwapMetrics(context.Context, []models.Metrics) ([]models.Metrics, map[string]*models.Metrics, error)
+}
+
+// Journal keeps a copy of the metrics outside the storage. Append is called
+// with every stored batch before the request is answered, in the order the
+// storage applied the writes of each series. Replace makes the metrics the only series when a
+// backup replaces them, before the storage does.
+type Journal interface {
+	Append(context.Context, ...models.Metrics) error
+	Replace(context.Context, []models.Metrics) error
+}
+
+// Pinger checks the database behind the storage.
+type Pinger interface {
+	Ping(context.Context) error
+}
+
 type StorageProvider struct {
 	Storage     MetricRepository
-	DB          *sql.DB
+	DB          Pinger
 	MetricsChan *chan models.Metrics
+	Cardinality *cardinality.Tracker
+	Auditor     *audit.Auditor
+	Persistence Journal
+	Health      *Health
+	queued      atomic.Int64
+	// journalMu orders the journal appends of a series like its storage
+	// writes. Replay keeps the last record of every series, so writes to
+	// different series don't need to be ordered and only the stripes of the
+	// written series are locked.
+	journalMu [journalStripes]sync.Mutex
+}
+
+const journalStripes = 64
+
+// lockSeries locks the journal stripes of the metrics, or all of them when
+// metrics is nil, in index order so batches can't deadlock, and returns the
+// function unlocking them.
+func (sp *StorageProvider) lockSeries(metrics []models.Metrics) func() {
+	var locked [journalStripes]bool
+	for _, m := range metrics {
+		h := fnv.New32a()
+		h.Write([]byte(metricKey(&m)))
+		locked[h.Sum32()%journalStripes] = true
+	}
+
+	stripes := make([]int, 0, journalStripes)
+	for i := range locked {
+		if locked[i] || metrics == nil {
+			stripes = append(stripes, i)
+			sp.journalMu[i].Lock()
+		}
+	}
+
+	return func() {
+		for _, i := range stripes {
+			sp.journalMu[i].Unlock()
+		}
+	}
+}
+
+// errJournal marks writes that were stored but not journaled.
+var errJournal = errors.New("journal metrics")
+
+// writeStatus returns the response status for an error returned by write.
+func writeStatus(err error) int {
+	if errors.Is(err, errJournal) {
+		return http.StatusInternalServerError
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// publish hands stored metrics over to MetricsChan. Senders wait for the
+// consumer, so the ones waiting are the ingestion queue.
+func (sp *StorageProvider) publish(metrics ...models.Metrics) {
+	sp.queued.Add(int64(len(metrics)))
+	for _, metric := range metrics {
+		*sp.MetricsChan <- *copyMetric(&metric)
+		sp.queued.Add(-1)
+	}
+}
+
+// QueueDepth returns the number of metrics waiting to be received from
+// MetricsChan.
+func (sp *StorageProvider) QueueDepth() int64 {
+	return sp.queued.Load()
+}
+
+// write stores the metrics and appends them to the journal. With auditing
+// enabled it also returns the values they replaced, see previousValues. The
+// error wraps errJournal when only the journal append failed.
+func (sp *StorageProvider) write(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, map[string]*models.Metrics, error) {
+	if sp.Persistence == nil {
+		return sp.store(ctx, metrics)
+	}
+
+	defer sp.lockSeries(metrics)()
+	stored, previous, err := sp.store(ctx, metrics)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := sp.Persistence.Append(ctx, stored...); err != nil {
+		return stored, previous, fmt.Errorf("%w: %w", errJournal, err)
+	}
+	return stored, previous, nil
+}
+
+func (sp *StorageProvider) store(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, map[string]*models.Metrics, error) {
+	if sp.Auditor == nil {
+		stored, err := sp.Storage.AddMetrics(ctx, metrics)
+		return stored, nil, err
+	}
+
+	if sw, ok := sp.Storage.(Swapper); ok {
+		stored, previous, err := sw.SwapMetrics(ctx, metrics)
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return stored, previous, err
+		}
+	}
+
+	stored, err := sp.Storage.AddMetrics(ctx, metrics)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stored, previousValues(metrics, stored), nil
+}
+
+// StoreInternal writes metrics the server produces itself, e.g. its own
+// telemetry, on behalf of source. Their series are admitted by the
+// cardinality tracker like the ones of clients, and the series over the
+// limits are left out and counted as rejected.
+func (sp *StorageProvider) StoreInternal(ctx context.Context, source string, metrics []models.Metrics) error {
+	admitted := make([]models.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		if sp.Cardinality != nil {
+			if err := sp.Cardinality.Reserve(source, m.MType, m.ID); err != nil {
+				reject(RejectCardinality)
+				continue
+			}
+		}
+		admitted = append(admitted, m)
+	}
+
+	if len(admitted) == 0 {
+		return nil
+	}
+
+	_, _, err := sp.write(ctx, admitted)
+	sp.settle(admitted, err == nil || errors.Is(err, errJournal))
+	return err
+}
+
+// admit reserves the series of the metric in the cardinality tracker. Every
+// admitted metric must be settled once the write is done.
+func (sp *StorageProvider) admit(r *http.Request, metric *models.Metrics) error {
+	if sp.Cardinality == nil {
+		return nil
+	}
+
+	err := sp.Cardinality.Reserve(ClientSource(r), metric.MType, metric.ID)
+	if err != nil {
+		reject(RejectCardinality)
+	}
+	return err
+}
+
+// settle commits the reservations of admitted metrics once they are stored
+// and releases them when the write failed.
+func (sp *StorageProvider) settle(metrics []models.Metrics, stored bool) {
+	if sp.Cardinality == nil {
+		return
+	}
+
+	for _, m := range metrics {
+		if stored {
+			sp.Cardinality.Commit(m.MType, m.ID)
+		} else {
+			sp.Cardinality.Release(m.MType, m.ID)
+		}
+	}
+}
+
+func (sp *StorageProvider) GetCardinalityReport(w http.ResponseWriter, r *http.Request) {
+	if sp.Cardinality == nil {
+		http.Error(w, "cardinality tracking is disabled", http.StatusNotFound)
+		return
+	}
+
+	n := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 1 {
+			http.Error(w, "Bad request.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(sp.Cardinality.Report(n)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
 
 func (sp *StorageProvider) PingDB(w http.ResponseWriter, r *http.Request) {
+	// Without a database there is nothing to check.
 	if sp.DB == nil {
-		http.Error(w, "database connection failed", http.StatusInternalServerError)
 		return
 	}
 	ctx, cancel := context.WithTimeout(r.Context(), 1*time.Second)
 	defer cancel()
-	if err := sp.DB.PingContext(ctx); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := sp.DB.Ping(ctx); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, pgretry.ErrCircuitOpen) {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, err.Error(), status)
 	}
 }
 
@@ -197,23 +570,61 @@ func (sp *StorageProvider) UpdateMetrics(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	valid := make([]models.Metrics, 0, len(metrics))
+	rejected := make([]models.RejectedMetric, 0)
+	for i, metric := range metrics {
+		if err := metric.Validate(); err != nil {
+			reject(RejectInvalid)
+			rejected = append(rejected, models.RejectedMetric{Index: i, ID: metric.ID, Reason: err.Error()})
+			continue
+		}
+		if err := sp.admit(r, &metric); err != nil {
+			rejected = append(rejected, models.RejectedMetric{Index: i, ID: metric.ID, Reason: err.Error()})
+			continue
+		}
+		valid = append(valid, metric)
+	}
+
+	strict := strings.EqualFold(r.Header.Get(BatchModeHeader), BatchModeStrict)
+	if len(rejected) > 0 && (strict || len(valid) == 0) {
+		sp.settle(valid, false)
+		http.Error(w, rejectedMessage(rejected), http.StatusUnprocessableEntity)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
 	defer cancel()
-	metrics, err := sp.Storage.AddMetrics(ctx, metrics)
+	metrics, old, err := sp.write(ctx, valid)
+	sp.settle(valid, err == nil || errors.Is(err, errJournal))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		http.Error(w, err.Error(), writeStatus(err))
 		return
 	}
 
+	sp.audit(r, audit.ActionBatchUpdate, old, metrics)
+
+	var body any = metrics
+	if len(rejected) > 0 {
+		body = models.BatchResult{Accepted: metrics, Rejected: rejected}
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(metrics); err != nil {
+	if err := enc.Encode(body); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	for _, metric := range metrics {
-		*sp.MetricsChan <- metric
+	sp.publish(metrics...)
+}
+
+func rejectedMessage(rejected []models.RejectedMetric) string {
+	reasons := make([]string, 0, len(rejected))
+	for _, rm := range rejected {
+		reasons = append(reasons, fmt.Sprintf("metric %d (%q): %s", rm.Index, rm.ID, rm.Reason))
 	}
+
+	return strings.Join(reasons, "; ")
 }
 
 func (sp *StorageProvider) UpdateMetric(w http.ResponseWriter, r *http.Request) {
@@ -225,21 +636,35 @@ func (sp *StorageProvider) UpdateMetric(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if err := metric.Validate(); err != nil {
+		reject(RejectInvalid)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := sp.admit(r, metric); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
 	defer cancel()
-	metric, err := sp.Storage.AddMetric(ctx, metric)
+	stored, old, err := sp.write(ctx, []models.Metrics{*metric})
+	sp.settle([]models.Metrics{*metric}, err == nil || errors.Is(err, errJournal))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		http.Error(w, err.Error(), writeStatus(err))
 		return
 	}
 
+	sp.audit(r, audit.ActionUpdate, old, stored)
+
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(metric); err != nil {
+	if err := enc.Encode(stored[0]); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	*sp.MetricsChan <- *metric
+	sp.publish(stored...)
 }
 
 func (sp *StorageProvider) GetMetricsPage(w http.ResponseWriter, r *http.Request) {
@@ -322,42 +747,58 @@ func (sp *StorageProvider) GetCounterMetricValue(w http.ResponseWriter, r *http.
 }
 
 func (sp *StorageProvider) UpdateGaugeMetric(w http.ResponseWriter, r *http.Request) {
-	metricsCh := sp.MetricsChan
 	v, err := strconv.ParseFloat(chi.URLParam(r, "value"), 64)
 	if err != nil {
+		reject(RejectInvalid)
 		http.Error(w, "Bad request.", http.StatusBadRequest)
 		return
 	}
 
 	metric := models.Metrics{ID: chi.URLParam(r, "name"), Value: &v, MType: "gauge"}
+	if err := sp.admit(r, &metric); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
 	defer cancel()
-	_, err = sp.Storage.AddMetric(ctx, &metric)
+	stored, old, err := sp.write(ctx, []models.Metrics{metric})
+	sp.settle([]models.Metrics{metric}, err == nil || errors.Is(err, errJournal))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		http.Error(w, err.Error(), writeStatus(err))
 		return
 	}
+
+	sp.audit(r, audit.ActionUpdate, old, stored)
 	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
-	*metricsCh <- metric
+	sp.publish(stored...)
 }
 
 func (sp *StorageProvider) UpdateCounterMetric(w http.ResponseWriter, r *http.Request) {
-	metricsCh := sp.MetricsChan
 	v, err := strconv.ParseInt(chi.URLParam(r, "value"), 10, 64)
 	if err != nil {
+		reject(RejectInvalid)
 		http.Error(w, "Bad request.", http.StatusBadRequest)
 		return
 	}
 
 	metric := models.Metrics{ID: chi.URLParam(r, "name"), Delta: &v, MType: "counter"}
+	if err := sp.admit(r, &metric); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
 	defer cancel()
-	_, err = sp.Storage.AddMetric(ctx, &metric)
+	stored, old, err := sp.write(ctx, []models.Metrics{metric})
+	sp.settle([]models.Metrics{metric}, err == nil || errors.Is(err, errJournal))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		http.Error(w, err.Error(), writeStatus(err))
 		return
 	}
 
+	sp.audit(r, audit.ActionUpdate, old, stored)
+
 	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
-	*metricsCh <- metric
+	sp.publish(stored...)
 }
@@ -3,16 +3,23 @@ package handlers_test
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/vladkonst/metrics-alerting/app"
+	"github.com/vladkonst/metrics-alerting/handlers"
 	"github.com/vladkonst/metrics-alerting/internal/configs"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/pgretry"
 )
 
 var a *app.App
@@ -28,6 +35,30 @@ func init() {
 	}()
 }
 
+// newTestServer serves a new app with the intervals config until the test
+// ends. Its MetricsChan is drained like Run does.
+func newTestServer(t *testing.T, intervals *configs.ServerIntervalsCfg) (*httptest.Server, *app.App) {
+	t.Helper()
+	cfg := configs.ServerCfg{IntervalsCfg: intervals, NetAddressCfg: &configs.NetAddressCfg{}}
+	ta, err := app.NewApp(nil, &cfg)
+	require.NoError(t, err)
+	go func() {
+		for range *ta.MetricsChan {
+			continue
+		}
+	}()
+
+	ts := httptest.NewUnstartedServer(ta.GetRouter())
+	if tlsCfg := ta.TLSConfig(); tlsCfg != nil {
+		ts.TLS = tlsCfg
+		ts.StartTLS()
+	} else {
+		ts.Start()
+	}
+	t.Cleanup(ts.Close)
+	return ts, ta
+}
+
 type want struct {
 	contentType string
 	statusCode  int
@@ -140,6 +171,16 @@ func TestUpdatesMetric(t *testing.T) {
 			request: "/updates",
 			body:    `[{"id": "test1", "type": "gauge", "value": 1.1},{"id": "test2", "type": "counter", "delta": 1}]`,
 		},
+		{
+			name: "partially accepted metrics update test",
+			want: want{
+				contentType: "application/json",
+				statusCode:  207,
+				body:        `{"accepted": [{"id": "test3", "type": "gauge", "value": 2.2}], "rejected": [{"index": 1, "id": "test4", "reason": "provided metric type is incorrect"}, {"index": 2, "id": "test5", "reason": "metric value is missing"}]}`,
+			},
+			request: "/updates",
+			body:    `[{"id": "test3", "type": "gauge", "value": 2.2},{"id": "test4", "type": "unsupported", "value": 1},{"id": "test5", "type": "counter"}]`,
+		},
 	}
 
 	for _, test := range tests {
@@ -164,6 +205,25 @@ func TestUpdatesMetric(t *testing.T) {
 	}
 }
 
+func TestUpdatesMetricStrictMode(t *testing.T) {
+	ts := httptest.NewServer(a.GetRouter())
+	defer ts.Close()
+	body := `[{"id": "strict1", "type": "gauge", "value": 1.1},{"id": "strict2", "type": "unsupported", "value": 1}]`
+	req, err := http.NewRequest("POST", ts.URL+"/updates", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "")
+	req.Header.Set("X-Batch-Mode", "strict")
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	res := testRequest(t, ts, "GET", "/value/gauge/strict1", nil)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
 func TestUpdateMetric(t *testing.T) {
 	ts := httptest.NewServer(a.GetRouter())
 	defer ts.Close()
@@ -385,3 +445,110 @@ func TestUpdateCounterMetric(t *testing.T) {
 		})
 	}
 }
+
+type pingerFunc func(context.Context) error
+
+func (f pingerFunc) Ping(ctx context.Context) error {
+	return f(ctx)
+}
+
+func TestPingDB(t *testing.T) {
+	tests := []struct {
+		name       string
+		db         handlers.Pinger
+		statusCode int
+	}{
+		{name: "no database test", statusCode: http.StatusOK},
+		{name: "healthy database test", db: pingerFunc(func(context.Context) error { return nil }), statusCode: http.StatusOK},
+		{name: "failing database test", db: pingerFunc(func(context.Context) error { return errors.New("down") }), statusCode: http.StatusInternalServerError},
+		{
+			name:       "degraded database test",
+			db:         pingerFunc(func(context.Context) error { return fmt.Errorf("database is degraded: %w", pgretry.ErrCircuitOpen) }),
+			statusCode: http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sp := &handlers.StorageProvider{DB: test.db}
+			w := httptest.NewRecorder()
+			sp.PingDB(w, httptest.NewRequest("GET", "/ping", nil))
+			assert.Equal(t, test.statusCode, w.Code)
+		})
+	}
+}
+
+func TestCardinalityQuotaOnFailedWrites(t *testing.T) {
+	ts, _ := newTestServer(t, &configs.ServerIntervalsCfg{MaxSeries: 1})
+	body := `[{"id": "quota1", "type": "gauge", "value": 1.1},{"id": "quota2", "type": "unsupported", "value": 1}]`
+	req, err := http.NewRequest("POST", ts.URL+"/updates", bytes.NewBufferString(body))
+	require.NoError(t, err)
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Set("X-Batch-Mode", "strict")
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	assert.Equal(t, http.StatusOK, testRequest(t, ts, "POST", "/update/gauge/quota3/1", nil).StatusCode)
+	assert.Equal(t, http.StatusUnprocessableEntity, testRequest(t, ts, "POST", "/update/gauge/quota4/1", nil).StatusCode)
+}
+
+type failingJournal struct{}
+
+func (failingJournal) Append(context.Context, ...models.Metrics) error {
+	return errors.New("disk full")
+}
+
+func (failingJournal) Replace(context.Context, []models.Metrics) error {
+	return nil
+}
+
+func TestJournalFailure(t *testing.T) {
+	ts, ja := newTestServer(t, &configs.ServerIntervalsCfg{})
+	ja.StorageProvider.Persistence = failingJournal{}
+	assert.Equal(t, http.StatusInternalServerError, testRequest(t, ts, "POST", "/update/counter/journaled/1", nil).StatusCode)
+	resp, err := ts.Client().Post(ts.URL+"/updates", "application/json", bytes.NewBufferString(`[{"id": "journaled", "type": "gauge", "value": 1}]`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func TestStoreInternal(t *testing.T) {
+	_, ia := newTestServer(t, &configs.ServerIntervalsCfg{MaxSeries: 2})
+	ctx := context.Background()
+	one, two := 1.0, 2.0
+	_, err := ia.Storage.AddMetrics(ctx, []models.Metrics{{ID: "client", MType: "gauge", Value: &one}})
+	require.NoError(t, err)
+	ia.StorageProvider.Cardinality.Seed("", "gauge", "client")
+	require.NoError(t, ia.StorageProvider.StoreInternal(ctx, "self", []models.Metrics{
+		{ID: "server_a", MType: "gauge", Value: &one},
+		{ID: "server_b", MType: "gauge", Value: &two},
+	}))
+
+	gauges, err := ia.Storage.GetGaugesValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"client": 1, "server_a": 1}, gauges, "series over the limit are left out")
+	assert.Equal(t, 2, ia.StorageProvider.Cardinality.Report(10).Series)
+}
+
+func TestJournalOrder(t *testing.T) {
+	ts, ja := newTestServer(t, &configs.ServerIntervalsCfg{})
+	journal := &recordingJournal{}
+	ja.StorageProvider.Persistence = journal
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := ts.Client().Post(ts.URL+"/update/counter/ordered/1", "text/plain", nil)
+			if assert.NoError(t, err) {
+				res.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(50), *journal.last["counter:ordered"].Delta, "the last journaled value is the last stored one")
+}
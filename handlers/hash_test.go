@@ -0,0 +1,162 @@
+package handlers_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/configs"
+)
+
+func sign(key, body string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHashMiddleware(t *testing.T) {
+	key := "secret"
+	ts, _ := newTestServer(t, &configs.ServerIntervalsCfg{HashKey: key})
+	body := `{"id": "signed", "type": "gauge", "value": 1.1}`
+	tests := []struct {
+		name       string
+		hash       string
+		statusCode int
+	}{
+		{
+			name:       "valid hash test",
+			hash:       sign(key, body),
+			statusCode: 200,
+		},
+		{
+			name:       "missing hash test",
+			statusCode: 400,
+		},
+		{
+			name:       "invalid hash test",
+			hash:       sign("other", body),
+			statusCode: 400,
+		},
+		{
+			name:       "malformed hash test",
+			hash:       "not hex",
+			statusCode: 400,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", ts.URL+"/update", bytes.NewBufferString(body))
+			require.NoError(t, err)
+			req.Header.Add("Content-Type", "application/json")
+			req.Header.Set("Accept-Encoding", "")
+			if test.hash != "" {
+				req.Header.Set("HashSHA256", test.hash)
+			}
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, test.statusCode, resp.StatusCode)
+			if test.statusCode == 200 {
+				b, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				assert.Equal(t, sign(key, string(b)), resp.Header.Get("HashSHA256"))
+			}
+		})
+	}
+}
+
+func TestReplayProtection(t *testing.T) {
+	key := "secret"
+	ts, _ := newTestServer(t, &configs.ServerIntervalsCfg{HashKey: key, ReplayWindow: 60, NonceCacheSize: 2})
+	body := `[{"id": "replayed", "type": "counter", "delta": 1}]`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	tests := []struct {
+		name       string
+		timestamp  string
+		nonce      string
+		statusCode int
+	}{
+		{
+			name:       "fresh request test",
+			timestamp:  now,
+			nonce:      "nonce1",
+			statusCode: 200,
+		},
+		{
+			name:       "replayed request test",
+			timestamp:  now,
+			nonce:      "nonce1",
+			statusCode: 400,
+		},
+		{
+			name:       "stale request test",
+			timestamp:  stale,
+			nonce:      "nonce2",
+			statusCode: 400,
+		},
+		{
+			name:       "request without nonce test",
+			statusCode: 400,
+		},
+		{
+			name:       "second fresh request test",
+			timestamp:  now,
+			nonce:      "nonce3",
+			statusCode: 200,
+		},
+		{
+			name:       "full nonce cache test",
+			timestamp:  now,
+			nonce:      "nonce4",
+			statusCode: 503,
+		},
+		{
+			name:       "replayed request with full cache test",
+			timestamp:  now,
+			nonce:      "nonce1",
+			statusCode: 400,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", ts.URL+"/updates", bytes.NewBufferString(body))
+			require.NoError(t, err)
+			req.Header.Add("Content-Type", "application/json")
+			if test.nonce == "" {
+				req.Header.Set("HashSHA256", sign(key, body))
+			} else {
+				req.Header.Set("HashSHA256", sign(key, test.timestamp+"\n"+test.nonce+"\n"+body))
+				req.Header.Set("X-Timestamp", test.timestamp)
+				req.Header.Set("X-Nonce", test.nonce)
+			}
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, test.statusCode, resp.StatusCode)
+		})
+	}
+}
+
+func TestHashMiddlewareStreamsBackups(t *testing.T) {
+	ts, _ := newTestServer(t, &configs.ServerIntervalsCfg{HashKey: "secret"})
+	res, err := ts.Client().Get(ts.URL + "/admin/backup")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Empty(t, res.Header.Get("HashSHA256"), "streamed backups are not buffered to be signed")
+	_, _, err = handlers.ReadBackup(res.Body)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server states reported by the readiness endpoint. Only a serving server is
+// ready.
+const (
+	StateStarting  = "starting"
+	StateRestoring = "restoring"
+	StateServing   = "serving"
+	StateDraining  = "draining"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+type ComponentStatus struct {
+	Status  string         `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// Check reports the status of a single dependency.
+type Check func(context.Context) ComponentStatus
+
+// CheckError turns the result of a probe into a status.
+func CheckError(err error) ComponentStatus {
+	if err != nil {
+		return ComponentStatus{Status: StatusFail, Error: err.Error()}
+	}
+	return ComponentStatus{Status: StatusOK}
+}
+
+type Readiness struct {
+	Status     string                     `json:"status"`
+	State      string                     `json:"state"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// Health tracks the server state and the checks of its dependencies.
+type Health struct {
+	state  atomic.Value
+	mu     sync.Mutex
+	names  []string
+	checks map[string]Check
+}
+
+// NewHealth returns a health in the starting state.
+func NewHealth() *Health {
+	h := &Health{checks: make(map[string]Check)}
+	h.state.Store(StateStarting)
+	return h
+}
+
+// AddCheck registers a check, replacing an existing one with the same name.
+func (h *Health) AddCheck(name string, c Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = c
+}
+
+func (h *Health) State() string {
+	return h.state.Load().(string)
+}
+
+func (h *Health) SetState(state string) {
+	h.state.Store(state)
+}
+
+// Transition changes the state only if it still is from, so a restore
+// finishing during a drain does not make the server ready again.
+func (h *Health) Transition(from, to string) bool {
+	return h.state.CompareAndSwap(from, to)
+}
+
+// Ready reports whether the server is serving. It doesn't run the checks.
+func (h *Health) Ready() bool {
+	return h.State() == StateServing
+}
+
+// Check runs every check and reports the server ready only when it is
+// serving and all checks pass.
+func (h *Health) Check(ctx context.Context) Readiness {
+	h.mu.Lock()
+	names := append([]string(nil), h.names...)
+	checks := make([]Check, 0, len(names))
+	for _, name := range names {
+		checks = append(checks, h.checks[name])
+	}
+	h.mu.Unlock()
+
+	res := Readiness{Status: StatusOK, State: h.State(), Components: make(map[string]ComponentStatus, len(names))}
+	if res.State != StateServing {
+		res.Status = StatusFail
+	}
+
+	for i, c := range checks {
+		cs := c(ctx)
+		if cs.Status != StatusOK {
+			res.Status = StatusFail
+		}
+		res.Components[names[i]] = cs
+	}
+
+	return res
+}
+
+// GetHealth answers liveness probes: the process is able to serve HTTP.
+func (h *Health) GetHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": StatusOK, "state": h.State()})
+}
+
+// GetReadiness answers readiness probes with the status of every component,
+// and 503 unless the server is ready.
+func (h *Health) GetReadiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	res := h.Check(ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	if res.Status != StatusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// GateWrites rejects writes with 503 while metrics are being restored, so
+// they don't interleave with the restored values.
+func (h *Health) GateWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.State() == StateRestoring {
+			reject(RejectRestoring)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "server is restoring metrics", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,102 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+)
+
+func TestReadiness(t *testing.T) {
+	ok := func(context.Context) handlers.ComponentStatus { return handlers.CheckError(nil) }
+	failing := func(context.Context) handlers.ComponentStatus { return handlers.CheckError(errors.New("down")) }
+	tests := []struct {
+		name       string
+		state      string
+		check      handlers.Check
+		statusCode int
+		status     string
+	}{
+		{name: "serving test", state: handlers.StateServing, check: ok, statusCode: http.StatusOK, status: handlers.StatusOK},
+		{name: "starting test", state: handlers.StateStarting, check: ok, statusCode: http.StatusServiceUnavailable, status: handlers.StatusFail},
+		{name: "restoring test", state: handlers.StateRestoring, check: ok, statusCode: http.StatusServiceUnavailable, status: handlers.StatusFail},
+		{name: "draining test", state: handlers.StateDraining, check: ok, statusCode: http.StatusServiceUnavailable, status: handlers.StatusFail},
+		{name: "failing component test", state: handlers.StateServing, check: failing, statusCode: http.StatusServiceUnavailable, status: handlers.StatusFail},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := handlers.NewHealth()
+			h.SetState(test.state)
+			h.AddCheck("storage", ok)
+			h.AddCheck("file", test.check)
+
+			w := httptest.NewRecorder()
+			h.GetReadiness(w, httptest.NewRequest("GET", "/readyz", nil))
+			assert.Equal(t, test.statusCode, w.Code)
+
+			var res handlers.Readiness
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+			assert.Equal(t, test.status, res.Status)
+			assert.Equal(t, test.state, res.State)
+			assert.Equal(t, handlers.StatusOK, res.Components["storage"].Status)
+			assert.Equal(t, test.check(context.Background()), res.Components["file"])
+
+			w = httptest.NewRecorder()
+			h.GetHealth(w, httptest.NewRequest("GET", "/healthz", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+func TestGateWrites(t *testing.T) {
+	h := handlers.NewHealth()
+	gated := h.GateWrites(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for state, statusCode := range map[string]int{
+		handlers.StateStarting:  http.StatusOK,
+		handlers.StateRestoring: http.StatusServiceUnavailable,
+		handlers.StateServing:   http.StatusOK,
+		handlers.StateDraining:  http.StatusOK,
+	} {
+		h.SetState(state)
+		w := httptest.NewRecorder()
+		gated.ServeHTTP(w, httptest.NewRequest("POST", "/update/", nil))
+		assert.Equal(t, statusCode, w.Code, state)
+	}
+
+	h.SetState(handlers.StateDraining)
+	assert.False(t, h.Transition(handlers.StateRestoring, handlers.StateServing))
+	assert.Equal(t, handlers.StateDraining, h.State())
+}
+
+func TestDebugMetrics(t *testing.T) {
+	ts := httptest.NewServer(a.GetRouter())
+	defer ts.Close()
+
+	res := testRequest(t, ts, "POST", "/update/gauge/telemetry/1.5", nil)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	res = testRequest(t, ts, "POST", "/update/gauge/telemetry/none", nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, err := ts.Client().Get(ts.URL + "/debug/metrics")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	b, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	body := string(b)
+	assert.Contains(t, body, `server_http_requests_total{route="/update/gauge/{name}/{value}",method="POST",status="200"}`)
+	assert.Contains(t, body, `server_http_request_duration_seconds_bucket{route="/update/gauge/{name}/{value}",method="POST",le="+Inf"}`)
+	assert.Contains(t, body, `server_rejected_total{reason="invalid"}`)
+	assert.Contains(t, body, `server_storage_operation_duration_seconds_count{operation="add_metrics"}`)
+	assert.Contains(t, body, "server_metrics_queue_depth ")
+}
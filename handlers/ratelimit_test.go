@@ -0,0 +1,57 @@
+package handlers_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/configs"
+)
+
+func TestRateLimit(t *testing.T) {
+	ts, _ := newTestServer(t, &configs.ServerIntervalsCfg{UpdatesRateLimit: 0.1, UpdatesBurst: 1})
+	send := func() *http.Response {
+		req, err := http.NewRequest("POST", ts.URL+"/updates", bytes.NewBufferString(`[{"id": "test", "type": "gauge", "value": 1.1}]`))
+		require.NoError(t, err)
+		req.Header.Add("Content-Type", "application/json")
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp
+	}
+
+	assert.Equal(t, http.StatusOK, send().StatusCode)
+	resp := send()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "10", resp.Header.Get("Retry-After"))
+
+	res := testRequest(t, ts, "POST", "/update/gauge/test/1", nil)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestClientSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity string
+		want     string
+	}{
+		{name: "identity test", identity: "agent@example", want: "agent@example"},
+		{name: "remote ip test", want: "192.0.2.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/updates", nil)
+			if test.identity != "" {
+				r = r.WithContext(handlers.WithIdentity(r.Context(), test.identity))
+			}
+			assert.Equal(t, test.want, handlers.ClientSource(r))
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"container/list"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	TimestampHeader = "X-Timestamp"
+	NonceHeader     = "X-Nonce"
+)
+
+var (
+	ErrStaleRequest    = errors.New("request timestamp is outside the allowed clock skew")
+	ErrReplayedRequest = errors.New("request nonce was already used")
+	ErrNonceCacheFull  = errors.New("too many signed requests, nonce cache is full")
+)
+
+type seenNonce struct {
+	nonce string
+	ts    time.Time
+}
+
+// ReplayGuard rejects signed requests whose timestamp is further than window
+// from the server clock and requests reusing a nonce seen within the window.
+// At most size nonces are remembered. Nonces are only forgotten once their
+// window has passed, so new requests are refused while the cache is full.
+type ReplayGuard struct {
+	mu     sync.Mutex
+	window time.Duration
+	size   int
+	seen   map[string]*list.Element
+	order  *list.List
+	now    func() time.Time
+}
+
+// NewReplayGuard returns nil when window is not positive, which disables
+// replay protection.
+func NewReplayGuard(window time.Duration, size int) *ReplayGuard {
+	if window <= 0 {
+		return nil
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	return &ReplayGuard{window: window, size: size, seen: make(map[string]*list.Element), order: list.New(), now: time.Now}
+}
+
+func (g *ReplayGuard) Check(timestamp, nonce string) error {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid request timestamp")
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	ts := time.Unix(sec, 0)
+	if ts.Before(now.Add(-g.window)) || ts.After(now.Add(g.window)) {
+		return ErrStaleRequest
+	}
+
+	for e := g.order.Front(); e != nil; e = g.order.Front() {
+		if sn := e.Value.(seenNonce); sn.ts.Before(now.Add(-g.window)) {
+			g.order.Remove(e)
+			delete(g.seen, sn.nonce)
+			continue
+		}
+		break
+	}
+
+	if _, ok := g.seen[nonce]; ok {
+		return ErrReplayedRequest
+	}
+
+	if g.order.Len() >= g.size {
+		return ErrNonceCacheFull
+	}
+
+	g.seen[nonce] = g.order.PushBack(seenNonce{nonce: nonce, ts: ts})
+	return nil
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+type identityKey struct{}
+
+// WithIdentity stores the authenticated client identity in ctx.
+func WithIdentity(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// Identity returns the authenticated client identity, if there is one.
+func Identity(ctx context.Context) string {
+	id, _ := ctx.Value(identityKey{}).(string)
+	return id
+}
+
+// ClientSource identifies the client a request came from: the authenticated
+// identity, otherwise the remote IP address. The identity, a token name or
+// client certificate common name, is the agent ID: anything an agent reports
+// about itself could be rotated to get around the limits keyed on it.
+func ClientSource(r *http.Request) string {
+	if id := Identity(r.Context()); id != "" {
+		return id
+	}
+
+	return RemoteIP(r)
+}
+
+func RemoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// TLSIdentityMiddleware uses the common name of a verified client
+// certificate as the client identity.
+func TLSIdentityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			if cn := r.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+				r = r.WithContext(WithIdentity(r.Context(), cn))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RealIPHeader carries the address of the agent that sent the request.
+const RealIPHeader = "X-Real-IP"
+
+// ParseSubnets parses a comma separated list of CIDRs.
+func ParseSubnets(s string) ([]*net.IPNet, error) {
+	subnets := make([]*net.IPNet, 0)
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted subnet %q: %w", cidr, err)
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets, nil
+}
+
+// TrustedSubnetMiddleware only lets through requests whose client address,
+// taken from X-Real-IP or the connection when the header is absent, belongs
+// to one of the subnets.
+func TrustedSubnetMiddleware(subnets []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr := r.Header.Get(RealIPHeader)
+			if addr == "" {
+				addr = RemoteIP(r)
+			}
+
+			ip := net.ParseIP(strings.TrimSpace(addr))
+			if ip == nil || !containsIP(subnets, ip) {
+				reject(RejectSubnet)
+				http.Error(w, "Forbidden.", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func containsIP(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
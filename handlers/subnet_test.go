@@ -0,0 +1,80 @@
+package handlers_test
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/internal/configs"
+)
+
+func TestTrustedSubnet(t *testing.T) {
+	ts, _ := newTestServer(t, &configs.ServerIntervalsCfg{TrustedSubnet: "192.168.0.0/24, 10.0.0.0/8"})
+	tests := []struct {
+		name       string
+		method     string
+		request    string
+		realIP     string
+		statusCode int
+	}{
+		{
+			name:       "trusted address test",
+			method:     "POST",
+			request:    "/update/gauge/subnet/1",
+			realIP:     "192.168.0.12",
+			statusCode: 200,
+		},
+		{
+			name:       "trusted batch address test",
+			method:     "POST",
+			request:    "/updates/",
+			realIP:     "10.1.2.3",
+			statusCode: 200,
+		},
+		{
+			name:       "untrusted address test",
+			method:     "POST",
+			request:    "/update/gauge/subnet/1",
+			realIP:     "192.168.1.12",
+			statusCode: 403,
+		},
+		{
+			name:       "malformed address test",
+			method:     "POST",
+			request:    "/updates/",
+			realIP:     "not an ip",
+			statusCode: 403,
+		},
+		{
+			name:       "connection address test",
+			method:     "POST",
+			request:    "/update/gauge/subnet/1",
+			statusCode: 403,
+		},
+		{
+			name:       "read route test",
+			method:     "GET",
+			request:    "/value/gauge/subnet",
+			realIP:     "192.168.1.12",
+			statusCode: 200,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, ts.URL+test.request, bytes.NewBufferString(`[{"id": "subnet", "type": "gauge", "value": 1}]`))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			if test.realIP != "" {
+				req.Header.Set("X-Real-IP", test.realIP)
+			}
+			resp, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, test.statusCode, resp.StatusCode)
+		})
+	}
+}
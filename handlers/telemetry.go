@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"github.com/vladkonst/metrics-alerting/internal/telemetry"
+)
+
+// Reasons for refusing a request or a metric.
+const (
+	RejectRateLimit    = "rate_limit"
+	RejectUnauthorized = "unauthorized"
+	RejectForbidden    = "forbidden"
+	RejectSubnet       = "subnet"
+	RejectSignature    = "signature"
+	RejectEncryption   = "encryption"
+	RejectInvalid      = "invalid"
+	RejectCardinality  = "cardinality"
+	RejectRestoring    = "restoring"
+)
+
+var (
+	requestsTotal = telemetry.Default.Counter("http_requests_total",
+		"HTTP requests by route, method and status.", "route", "method", "status")
+	requestDuration = telemetry.Default.Histogram("http_request_duration_seconds",
+		"HTTP request latencies by route and method.", telemetry.DurationBuckets, "route", "method")
+	rejectedTotal = telemetry.Default.Counter("rejected_total",
+		"Refused requests and batch items by reason.", "reason")
+)
+
+func reject(reason string) {
+	rejectedTotal.Inc(reason)
+}
@@ -0,0 +1,144 @@
+package handlers_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/app"
+	"github.com/vladkonst/metrics-alerting/internal/cardinality"
+	"github.com/vladkonst/metrics-alerting/internal/configs"
+	"github.com/vladkonst/metrics-alerting/internal/tlsconfig"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, dir string) (*testCA, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	path := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	return &testCA{cert: cert, key: key}, path
+}
+
+func (ca *testCA) issue(t *testing.T, dir, cn string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	certPath, keyPath := filepath.Join(dir, cn+".pem"), filepath.Join(dir, cn+"-key.pem")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certPath, keyPath
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caPath := newTestCA(t, dir)
+	serverCert, serverKey := ca.issue(t, dir, "server", 2, x509.ExtKeyUsageServerAuth)
+	agentCert, agentKey := ca.issue(t, dir, "agent-1", 3, x509.ExtKeyUsageClientAuth)
+
+	ts, _ := newTestServer(t, &configs.ServerIntervalsCfg{
+		TLSCert:              serverCert,
+		TLSKey:               serverKey,
+		TLSClientCA:          caPath,
+		TLSRequireClientCert: true,
+	})
+
+	client := func(certFile, keyFile string) *http.Client {
+		r, err := tlsconfig.NewReloader(certFile, keyFile, caPath)
+		require.NoError(t, err)
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsconfig.ClientConfig(r)}}
+	}
+
+	resp, err := client(agentCert, agentKey).Post(ts.URL+"/update/gauge/tls/1", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, err = client(agentCert, agentKey).Get(ts.URL + "/api/v1/cardinality")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var report cardinality.Report
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, []cardinality.Entry{{Name: "agent-1", Series: 1}}, report.TopSources)
+
+	_, err = client("", "").Get(ts.URL + "/value/gauge/tls")
+	assert.Error(t, err, "request without client certificate")
+}
+
+func TestRequireClientCertNeedsCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, _ := newTestCA(t, dir)
+	serverCert, serverKey := ca.issue(t, dir, "server", 2, x509.ExtKeyUsageServerAuth)
+	for name, intervals := range map[string]*configs.ServerIntervalsCfg{
+		"without ca":  {TLSCert: serverCert, TLSKey: serverKey, TLSRequireClientCert: true},
+		"without tls": {TLSRequireClientCert: true},
+	} {
+		cfg := configs.ServerCfg{IntervalsCfg: intervals, NetAddressCfg: &configs.NetAddressCfg{}}
+		_, err := app.NewApp(nil, &cfg)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestReloaderDetectsChanges(t *testing.T) {
+	dir := t.TempDir()
+	ca, caPath := newTestCA(t, dir)
+	certPath, keyPath := ca.issue(t, dir, "server", 2, x509.ExtKeyUsageServerAuth)
+	r, err := tlsconfig.NewReloader(certPath, keyPath, caPath)
+	require.NoError(t, err)
+
+	changed, err := r.Reload()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	ca.issue(t, dir, "server", 4, x509.ExtKeyUsageServerAuth)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(certPath, later, later))
+	changed, err = r.Reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+}
@@ -0,0 +1,137 @@
+// Package audit records who changed which metrics. Events are delivered to
+// the sinks asynchronously: every sink has its own bounded queue and events
+// are dropped rather than blocking the caller when a queue is full.
+package audit
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vladkonst/metrics-alerting/internal/logger"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+)
+
+const (
+	ActionUpdate      = "update"
+	ActionBatchUpdate = "batch_update"
+	ActionRestore     = "restore"
+)
+
+type Change struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Old  *models.Metrics `json:"old,omitempty"`
+	New  *models.Metrics `json:"new,omitempty"`
+}
+
+type Event struct {
+	Time     time.Time `json:"ts"`
+	Action   string    `json:"action"`
+	Identity string    `json:"identity,omitempty"`
+	IP       string    `json:"ip"`
+	Metrics  []string  `json:"metrics"`
+	Changes  []Change  `json:"changes"`
+}
+
+type Sink interface {
+	Send(Event) error
+	Close() error
+}
+
+type worker struct {
+	sink   Sink
+	events chan Event
+}
+
+type Auditor struct {
+	workers []worker
+	wg      sync.WaitGroup
+	dropped atomic.Int64
+	// mu guards closed. Record holds it shared while queueing, so Close
+	// never closes a queue under a send.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewAuditor starts a delivery goroutine per sink, each with a queue of
+// bufferSize events. It returns nil when there are no sinks.
+func NewAuditor(bufferSize int, sinks ...Sink) *Auditor {
+	if len(sinks) == 0 {
+		return nil
+	}
+
+	a := &Auditor{}
+	for _, s := range sinks {
+		w := worker{sink: s, events: make(chan Event, bufferSize)}
+		a.workers = append(a.workers, w)
+		a.wg.Add(1)
+		go a.deliver(w)
+	}
+
+	return a
+}
+
+func (a *Auditor) deliver(w worker) {
+	defer a.wg.Done()
+	log := logger.Get()
+	for e := range w.events {
+		if err := w.sink.Send(e); err != nil {
+			log.Error().Err(err).Str("action", e.Action).Msg("failed to deliver audit event")
+		}
+	}
+
+	if err := w.sink.Close(); err != nil {
+		log.Error().Err(err).Msg("failed to close audit sink")
+	}
+}
+
+// Record queues the event for every sink without blocking. Events recorded
+// after Close are dropped.
+func (a *Auditor) Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	if e.Metrics == nil {
+		e.Metrics = make([]string, 0, len(e.Changes))
+		for _, c := range e.Changes {
+			e.Metrics = append(e.Metrics, c.ID)
+		}
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		a.dropped.Add(int64(len(a.workers)))
+		return
+	}
+
+	for _, w := range a.workers {
+		select {
+		case w.events <- e:
+		default:
+			a.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped returns the number of events lost because a sink queue was full
+// or the auditor was closed.
+func (a *Auditor) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+// Close delivers the queued events and closes the sinks. It may be called
+// while handlers still record events.
+func (a *Auditor) Close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		for _, w := range a.workers {
+			close(w.events)
+		}
+	}
+	a.mu.Unlock()
+	a.wg.Wait()
+}
@@ -0,0 +1,38 @@
+package audit_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vladkonst/metrics-alerting/internal/audit"
+)
+
+type countingSink struct {
+	mu   sync.Mutex
+	sent int
+}
+
+func (s *countingSink) Send(audit.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent++
+	return nil
+}
+
+func (s *countingSink) Close() error {
+	return nil
+}
+
+func TestRecordAfterClose(t *testing.T) {
+	sink := &countingSink{}
+	a := audit.NewAuditor(10, sink)
+	a.Record(audit.Event{Action: audit.ActionUpdate})
+	a.Close()
+
+	assert.NotPanics(t, func() { a.Record(audit.Event{Action: audit.ActionUpdate}) })
+	a.Close()
+	assert.Equal(t, 1, sink.sent)
+	assert.Equal(t, int64(1), a.Dropped())
+}
@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// FileSink appends events to a file as JSON lines.
+type FileSink struct {
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *FileSink) Send(e Event) error {
+	return s.enc.Encode(e)
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+// HTTPSink posts every event as a JSON document to a URL.
+type HTTPSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPSink(url string) *HTTPSink {
+	return &HTTPSink{url: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (s *HTTPSink) Send(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("audit endpoint responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (s *HTTPSink) Close() error {
+	return nil
+}
@@ -0,0 +1,224 @@
+package cardinality
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrSeriesLimit       = errors.New("series limit exceeded")
+	ErrSourceSeriesLimit = errors.New("series limit per source exceeded")
+)
+
+type series struct {
+	mtype  string
+	name   string
+	source string
+	// pending counts the writes that reserved the series and haven't been
+	// committed or released yet.
+	pending int
+	stored  bool
+}
+
+// Tracker counts distinct series (metric type and name) and the source that
+// created each of them. New series are refused once either the global or the
+// per-source limit is reached; writes to known series are always admitted.
+// A zero limit disables the corresponding check.
+//
+// Writes reserve their series before they are stored and commit or release
+// them afterwards, so series that were never stored don't use up the quota.
+type Tracker struct {
+	mu                 sync.Mutex
+	maxSeries          int
+	maxSeriesPerSource int
+	series             map[string]*series
+	sources            map[string]int
+}
+
+func NewTracker(maxSeries, maxSeriesPerSource int) *Tracker {
+	return &Tracker{
+		maxSeries:          maxSeries,
+		maxSeriesPerSource: maxSeriesPerSource,
+		series:             make(map[string]*series),
+		sources:            make(map[string]int),
+	}
+}
+
+func key(mtype, name string) string {
+	return mtype + ":" + name
+}
+
+// Admit registers the series for the source or returns an error if that would
+// exceed one of the limits.
+func (t *Tracker) Admit(source, mtype, name string) error {
+	if err := t.Reserve(source, mtype, name); err != nil {
+		return err
+	}
+
+	t.Commit(mtype, name)
+	return nil
+}
+
+// Reserve admits the series like Admit but only until it is committed or
+// released. Reserved series count against the limits.
+func (t *Tracker) Reserve(source, mtype, name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := key(mtype, name)
+	if s, ok := t.series[k]; ok {
+		s.pending++
+		return nil
+	}
+
+	if t.maxSeries > 0 && len(t.series) >= t.maxSeries {
+		return fmt.Errorf("%w: %d series stored", ErrSeriesLimit, t.maxSeries)
+	}
+
+	if t.maxSeriesPerSource > 0 && t.sources[source] >= t.maxSeriesPerSource {
+		return fmt.Errorf("%w: %q already created %d series", ErrSourceSeriesLimit, source, t.maxSeriesPerSource)
+	}
+
+	t.series[k] = &series{mtype: mtype, name: name, source: source, pending: 1}
+	t.sources[source]++
+	return nil
+}
+
+// Commit marks a reserved series as stored.
+func (t *Tracker) Commit(mtype, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, ok := t.series[key(mtype, name)]; ok && s.pending > 0 {
+		s.pending--
+		s.stored = true
+	}
+}
+
+// Release drops a reservation of a write that failed. The series is
+// forgotten when no other write stored or reserved it.
+func (t *Tracker) Release(mtype, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := key(mtype, name)
+	s, ok := t.series[k]
+	if !ok || s.pending == 0 {
+		return
+	}
+
+	s.pending--
+	if s.pending == 0 && !s.stored {
+		delete(t.series, k)
+		t.sources[s.source]--
+		if t.sources[s.source] == 0 {
+			delete(t.sources, s.source)
+		}
+	}
+}
+
+// Seed registers already stored series without checking the limits, e.g.
+// after a restore on startup.
+func (t *Tracker) Seed(source, mtype, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := key(mtype, name)
+	if s, ok := t.series[k]; ok {
+		s.stored = true
+		return
+	}
+
+	t.series[k] = &series{mtype: mtype, name: name, source: source, stored: true}
+	t.sources[source]++
+}
+
+// Reset forgets every series, e.g. before a restore replacing them.
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.series = make(map[string]*series)
+	t.sources = make(map[string]int)
+}
+
+type Entry struct {
+	Name   string `json:"name"`
+	Series int    `json:"series"`
+}
+
+type LabelEntry struct {
+	Label  string `json:"label"`
+	Value  string `json:"value"`
+	Series int    `json:"series"`
+}
+
+type Report struct {
+	Series             int          `json:"series"`
+	MaxSeries          int          `json:"max_series"`
+	MaxSeriesPerSource int          `json:"max_series_per_source"`
+	TopNames           []Entry      `json:"top_names"`
+	TopLabelValues     []LabelEntry `json:"top_label_values"`
+	TopSources         []Entry      `json:"top_sources"`
+}
+
+// Report returns the series count with the top n metric names, label values
+// and sources. Metrics carry no labels apart from their type, so that is the
+// only label reported. Series that are only reserved are left out.
+func (t *Tracker) Report(n int) Report {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make(map[string]int)
+	types := make(map[string]int)
+	sources := make(map[string]int)
+	stored := 0
+	for _, s := range t.series {
+		if !s.stored {
+			continue
+		}
+		stored++
+		names[s.name]++
+		types[s.mtype]++
+		sources[s.source]++
+	}
+
+	labels := make([]LabelEntry, 0, len(types))
+	for v, c := range types {
+		labels = append(labels, LabelEntry{Label: "type", Value: v, Series: c})
+	}
+
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].Series != labels[j].Series {
+			return labels[i].Series > labels[j].Series
+		}
+		return labels[i].Value < labels[j].Value
+	})
+	if len(labels) > n {
+		labels = labels[:n]
+	}
+
+	return Report{
+		Series:             stored,
+		MaxSeries:          t.maxSeries,
+		MaxSeriesPerSource: t.maxSeriesPerSource,
+		TopNames:           top(names, n),
+		TopLabelValues:     labels,
+		TopSources:         top(sources, n),
+	}
+}
+
+func top(counts map[string]int, n int) []Entry {
+	entries := make([]Entry, 0, len(counts))
+	for name, c := range counts {
+		entries = append(entries, Entry{Name: name, Series: c})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Series != entries[j].Series {
+			return entries[i].Series > entries[j].Series
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+
+	return entries
+}
@@ -0,0 +1,96 @@
+package cardinality_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/internal/cardinality"
+)
+
+func TestTrackerAdmit(t *testing.T) {
+	tests := []struct {
+		name    string
+		global  int
+		source  int
+		writes  [][3]string
+		wantErr error
+	}{
+		{
+			name:   "unlimited test",
+			writes: [][3]string{{"a", "gauge", "m1"}, {"a", "gauge", "m2"}, {"b", "counter", "m1"}},
+		},
+		{
+			name:    "global limit test",
+			global:  2,
+			writes:  [][3]string{{"a", "gauge", "m1"}, {"b", "gauge", "m2"}, {"c", "gauge", "m3"}},
+			wantErr: cardinality.ErrSeriesLimit,
+		},
+		{
+			name:    "source limit test",
+			source:  1,
+			writes:  [][3]string{{"a", "gauge", "m1"}, {"b", "gauge", "m2"}, {"a", "gauge", "m3"}},
+			wantErr: cardinality.ErrSourceSeriesLimit,
+		},
+		{
+			name:   "existing series test",
+			global: 1,
+			source: 1,
+			writes: [][3]string{{"a", "gauge", "m1"}, {"b", "gauge", "m1"}, {"a", "gauge", "m1"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tr := cardinality.NewTracker(test.global, test.source)
+			var err error
+			for _, w := range test.writes {
+				if err = tr.Admit(w[0], w[1], w[2]); err != nil {
+					break
+				}
+			}
+			if test.wantErr == nil {
+				require.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestTrackerReport(t *testing.T) {
+	tr := cardinality.NewTracker(0, 0)
+	tr.Seed("", "gauge", "restored")
+	require.NoError(t, tr.Admit("a", "gauge", "m1"))
+	require.NoError(t, tr.Admit("a", "counter", "m1"))
+	require.NoError(t, tr.Admit("b", "gauge", "m2"))
+
+	report := tr.Report(2)
+	assert.Equal(t, 4, report.Series)
+	assert.Equal(t, []cardinality.Entry{{Name: "m1", Series: 2}, {Name: "m2", Series: 1}}, report.TopNames)
+	assert.Equal(t, []cardinality.Entry{{Name: "a", Series: 2}, {Name: "", Series: 1}}, report.TopSources)
+	assert.Equal(t, []cardinality.LabelEntry{{Label: "type", Value: "gauge", Series: 3}, {Label: "type", Value: "counter", Series: 1}}, report.TopLabelValues)
+}
+
+func TestTrackerReserve(t *testing.T) {
+	tr := cardinality.NewTracker(2, 0)
+	require.NoError(t, tr.Reserve("a", "gauge", "m1"))
+	require.NoError(t, tr.Reserve("b", "gauge", "m1"))
+	require.NoError(t, tr.Reserve("a", "gauge", "m2"))
+	assert.ErrorIs(t, tr.Reserve("a", "gauge", "m3"), cardinality.ErrSeriesLimit)
+	assert.Equal(t, 0, tr.Report(10).Series)
+
+	// m1 stays while the second write holds it, m2 is forgotten.
+	tr.Release("gauge", "m1")
+	tr.Release("gauge", "m2")
+	require.NoError(t, tr.Reserve("a", "gauge", "m3"))
+	assert.ErrorIs(t, tr.Reserve("a", "gauge", "m4"), cardinality.ErrSeriesLimit)
+
+	tr.Commit("gauge", "m1")
+	tr.Commit("gauge", "m3")
+	tr.Release("gauge", "m3")
+	report := tr.Report(10)
+	assert.Equal(t, 2, report.Series)
+	assert.Equal(t, []cardinality.Entry{{Name: "a", Series: 2}}, report.TopSources)
+}
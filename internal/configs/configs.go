@@ -8,6 +8,14 @@ import (
 	"github.com/caarlos0/env"
 )
 
+// Storage backends selected with -storage. An empty value picks Postgres
+// when a DSN is given and memory otherwise.
+const (
+	StorageMemory   = "memory"
+	StoragePostgres = "postgres"
+	StorageEmbedded = "embedded"
+)
+
 type ClientCfg struct {
 	IntervalsCfg  *ClientIntervalsCfg
 	NetAddressCfg *NetAddressCfg
@@ -24,6 +32,12 @@ func GetClientConfig() *ClientCfg {
 	flag.IntVar(&intervalCfg.PollInterval, "p", intervalCfg.PollInterval, "poll interval to update metrics")
 	flag.IntVar(&intervalCfg.RateLimit, "l", 1, "requests rate limit number")
 	flag.StringVar(&intervalCfg.HashKey, "k", "", "hash key")
+	flag.StringVar(&intervalCfg.CryptoKey, "crypto-key", "", "path to the server public key used to encrypt reports")
+	flag.StringVar(&intervalCfg.TLSCA, "tls-ca", "", "CA certificate to verify the server, enables HTTPS")
+	flag.StringVar(&intervalCfg.TLSCert, "tls-cert", "", "client certificate presented to the server, enables HTTPS")
+	flag.StringVar(&intervalCfg.TLSKey, "tls-key", "", "client certificate key")
+	flag.StringVar(&intervalCfg.Token, "token", "", "API token sent to the server")
+	flag.StringVar(&intervalCfg.MetricsAddress, "metrics-address", "", "local host:port serving the agent's own metrics at /metrics, empty to disable")
 	addr := &NetAddressCfg{Host: "localhost", Port: 8080}
 	flag.Var(addr, "a", "Server net address host:port")
 	flag.Parse()
@@ -40,13 +54,51 @@ func GetClientConfig() *ClientCfg {
 
 func GetServerConfig() *ServerCfg {
 	addr := &NetAddressCfg{Host: "localhost", Port: 8080}
-	intervalCfg := &ServerIntervalsCfg{StoreInterval: 300, FileStoragePath: "metrics.txt", Restore: true}
+	intervalCfg := &ServerIntervalsCfg{StoreInterval: 300, FileStoragePath: "metrics.txt", Restore: true, NonceCacheSize: 100000, TLSReloadInterval: 30, TokensFile: "tokens.json", AuditBuffer: 1024, WALSync: "interval", WALSyncInterval: 1000, WALCheckpointInterval: 300, SnapshotEncoding: "json", SnapshotKeep: 3, DBBreakerThreshold: 5, DBBreakerCooldown: 10, StoragePath: "metrics.db", CacheFlushInterval: 100, ShutdownTimeout: 10, ReadyMaxQueue: 1000}
 	flag.Var(addr, "a", "Server net address host:port")
 	flag.IntVar(&intervalCfg.StoreInterval, "i", intervalCfg.StoreInterval, "store interval to load metrics to the file")
-	flag.StringVar(&intervalCfg.FileStoragePath, "f", intervalCfg.FileStoragePath, "file with stored metrics")
+	flag.StringVar(&intervalCfg.FileStoragePath, "f", intervalCfg.FileStoragePath, "file with stored metrics, used with the memory storage")
+	flag.StringVar(&intervalCfg.Storage, "storage", "", "storage backend: memory, postgres or embedded")
+	flag.StringVar(&intervalCfg.StoragePath, "storage-path", intervalCfg.StoragePath, "database file of the embedded storage")
+	flag.BoolVar(&intervalCfg.CacheEnabled, "cache", false, "serve reads from an in-memory cache in front of the postgres or embedded storage")
+	flag.IntVar(&intervalCfg.CacheFlushInterval, "cache-flush-interval", intervalCfg.CacheFlushInterval, "milliseconds between cache flushes to the storage, 0 to write through")
+	flag.IntVar(&intervalCfg.ReadyMaxQueue, "ready-max-queue", intervalCfg.ReadyMaxQueue, "metrics waiting to be persisted before the server reports not ready, 0 for no limit")
+	flag.IntVar(&intervalCfg.SelfMetricsInterval, "self-metrics-interval", intervalCfg.SelfMetricsInterval, "interval in seconds to store the server's own metrics as server_* gauges, 0 to disable")
+	flag.IntVar(&intervalCfg.ShutdownTimeout, "shutdown-timeout", intervalCfg.ShutdownTimeout, "seconds to drain requests and persist metrics on shutdown, 0 to wait without limit")
+	flag.IntVar(&intervalCfg.DrainDelay, "drain-delay", intervalCfg.DrainDelay, "seconds the server keeps serving after readiness reports draining, so load balancers stop routing to it; 0 shuts down right away")
 	flag.StringVar(&intervalCfg.DatabaseDSN, "d", "", "database connection string")
+	flag.IntVar(&intervalCfg.DBMaxConns, "db-max-conns", 0, "maximum size of the database connection pool, 0 for the driver default")
+	flag.IntVar(&intervalCfg.DBMinConns, "db-min-conns", 0, "number of database connections kept open")
+	flag.IntVar(&intervalCfg.DBBreakerThreshold, "db-breaker-threshold", intervalCfg.DBBreakerThreshold, "consecutive database failures before queries are rejected, 0 to disable")
+	flag.IntVar(&intervalCfg.DBBreakerCooldown, "db-breaker-cooldown", intervalCfg.DBBreakerCooldown, "seconds to reject database queries before trying again")
 	flag.StringVar(&intervalCfg.HashKey, "k", "", "hash key")
 	flag.BoolVar(&intervalCfg.Restore, "r", intervalCfg.Restore, "allow metrics load from file on server start")
+	flag.IntVar(&intervalCfg.MaxSeries, "max-series", 0, "maximum number of stored series, 0 for unlimited")
+	flag.IntVar(&intervalCfg.MaxSeriesPerSource, "max-series-per-source", 0, "maximum number of series created by one authenticated client or IP, 0 for unlimited")
+	flag.Float64Var(&intervalCfg.UpdateRateLimit, "update-rate", 0, "requests per second allowed to /update per client, 0 for unlimited")
+	flag.IntVar(&intervalCfg.UpdateBurst, "update-burst", 0, "burst of requests allowed to /update per client")
+	flag.Float64Var(&intervalCfg.UpdatesRateLimit, "updates-rate", 0, "requests per second allowed to /updates per client, 0 for unlimited")
+	flag.IntVar(&intervalCfg.UpdatesBurst, "updates-burst", 0, "burst of requests allowed to /updates per client")
+	flag.IntVar(&intervalCfg.ReplayWindow, "replay-window", 0, "allowed clock skew in seconds for signed requests, enables replay protection")
+	flag.IntVar(&intervalCfg.NonceCacheSize, "nonce-cache-size", intervalCfg.NonceCacheSize, "number of request nonces remembered for replay protection, further signed requests within the window are refused")
+	flag.StringVar(&intervalCfg.CryptoKey, "crypto-key", "", "path to the private key used to decrypt agent reports")
+	flag.StringVar(&intervalCfg.TLSCert, "tls-cert", "", "server certificate, enables HTTPS")
+	flag.StringVar(&intervalCfg.TLSKey, "tls-key", "", "server certificate key")
+	flag.StringVar(&intervalCfg.TLSClientCA, "tls-client-ca", "", "CA certificate to verify agent certificates")
+	flag.BoolVar(&intervalCfg.TLSRequireClientCert, "tls-require-client-cert", false, "reject agents without a valid certificate")
+	flag.IntVar(&intervalCfg.TLSReloadInterval, "tls-reload-interval", intervalCfg.TLSReloadInterval, "interval in seconds to check TLS files for changes")
+	flag.StringVar(&intervalCfg.TrustedSubnet, "t", "", "comma separated CIDRs allowed to send metrics")
+	flag.BoolVar(&intervalCfg.AuthEnabled, "auth", false, "require API tokens")
+	flag.StringVar(&intervalCfg.TokensFile, "tokens-file", intervalCfg.TokensFile, "file with API tokens when no database is configured")
+	flag.StringVar(&intervalCfg.AuditFile, "audit-file", "", "file to append audit events to as JSON lines")
+	flag.StringVar(&intervalCfg.AuditURL, "audit-url", "", "URL to post audit events to")
+	flag.IntVar(&intervalCfg.AuditBuffer, "audit-buffer", intervalCfg.AuditBuffer, "number of audit events queued per sink before they are dropped")
+	flag.StringVar(&intervalCfg.WALPath, "wal", "", "write-ahead log file for the in-memory storage, empty to disable")
+	flag.StringVar(&intervalCfg.WALSync, "wal-sync", intervalCfg.WALSync, "WAL fsync policy: always, interval or never")
+	flag.IntVar(&intervalCfg.WALSyncInterval, "wal-sync-interval", intervalCfg.WALSyncInterval, "interval in milliseconds between WAL fsyncs with the interval policy")
+	flag.IntVar(&intervalCfg.WALCheckpointInterval, "wal-checkpoint", intervalCfg.WALCheckpointInterval, "interval in seconds between snapshots when the store interval is 0, 0 to write them only on shutdown")
+	flag.StringVar(&intervalCfg.SnapshotEncoding, "snapshot-encoding", intervalCfg.SnapshotEncoding, "snapshot encoding: json or gzip")
+	flag.IntVar(&intervalCfg.SnapshotKeep, "snapshot-keep", intervalCfg.SnapshotKeep, "number of previous snapshots to keep")
 	flag.Parse()
 	if err := env.Parse(intervalCfg); err != nil {
 		fmt.Println("can't parse intervals from env variables")
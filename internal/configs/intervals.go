@@ -5,12 +5,56 @@ type ClientIntervalsCfg struct {
 	PollInterval   int    `env:"POLL_INTERVAL"`
 	HashKey        string `env:"KEY"`
 	RateLimit      int    `env:"RATE_LIMIT"`
+	CryptoKey      string `env:"CRYPTO_KEY"`
+	TLSCA          string `env:"TLS_CA"`
+	TLSCert        string `env:"TLS_CERT"`
+	TLSKey         string `env:"TLS_KEY"`
+	Token          string `env:"API_TOKEN"`
+	MetricsAddress string `env:"METRICS_ADDRESS"`
 }
 
 type ServerIntervalsCfg struct {
-	StoreInterval   int    `env:"STORE_INTERVAL"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	Restore         bool   `env:"RESTORE"`
-	DatabaseDSN     string `env:"DATABASE_DSN"`
-	HashKey         string `env:"KEY"`
+	StoreInterval         int     `env:"STORE_INTERVAL"`
+	FileStoragePath       string  `env:"FILE_STORAGE_PATH"`
+	Restore               bool    `env:"RESTORE"`
+	DatabaseDSN           string  `env:"DATABASE_DSN"`
+	HashKey               string  `env:"KEY"`
+	MaxSeries             int     `env:"MAX_SERIES"`
+	MaxSeriesPerSource    int     `env:"MAX_SERIES_PER_SOURCE"`
+	UpdateRateLimit       float64 `env:"UPDATE_RATE_LIMIT"`
+	UpdateBurst           int     `env:"UPDATE_BURST"`
+	UpdatesRateLimit      float64 `env:"UPDATES_RATE_LIMIT"`
+	UpdatesBurst          int     `env:"UPDATES_BURST"`
+	ReplayWindow          int     `env:"REPLAY_WINDOW"`
+	NonceCacheSize        int     `env:"NONCE_CACHE_SIZE"`
+	CryptoKey             string  `env:"CRYPTO_KEY"`
+	TLSCert               string  `env:"TLS_CERT"`
+	TLSKey                string  `env:"TLS_KEY"`
+	TLSClientCA           string  `env:"TLS_CLIENT_CA"`
+	TLSRequireClientCert  bool    `env:"TLS_REQUIRE_CLIENT_CERT"`
+	TLSReloadInterval     int     `env:"TLS_RELOAD_INTERVAL"`
+	TrustedSubnet         string  `env:"TRUSTED_SUBNET"`
+	AuthEnabled           bool    `env:"AUTH_ENABLED"`
+	TokensFile            string  `env:"TOKENS_FILE"`
+	AuditFile             string  `env:"AUDIT_FILE"`
+	AuditURL              string  `env:"AUDIT_URL"`
+	AuditBuffer           int     `env:"AUDIT_BUFFER"`
+	WALPath               string  `env:"WAL_PATH"`
+	WALSync               string  `env:"WAL_SYNC"`
+	WALSyncInterval       int     `env:"WAL_SYNC_INTERVAL"`
+	WALCheckpointInterval int     `env:"WAL_CHECKPOINT_INTERVAL"`
+	SnapshotEncoding      string  `env:"SNAPSHOT_ENCODING"`
+	SnapshotKeep          int     `env:"SNAPSHOT_KEEP"`
+	DBMaxConns            int     `env:"DB_MAX_CONNS"`
+	DBMinConns            int     `env:"DB_MIN_CONNS"`
+	DBBreakerThreshold    int     `env:"DB_BREAKER_THRESHOLD"`
+	DBBreakerCooldown     int     `env:"DB_BREAKER_COOLDOWN"`
+	Storage               string  `env:"STORAGE"`
+	StoragePath           string  `env:"STORAGE_PATH"`
+	CacheEnabled          bool    `env:"CACHE_ENABLED"`
+	CacheFlushInterval    int     `env:"CACHE_FLUSH_INTERVAL"`
+	ShutdownTimeout       int     `env:"SHUTDOWN_TIMEOUT"`
+	ReadyMaxQueue         int     `env:"READY_MAX_QUEUE"`
+	SelfMetricsInterval   int     `env:"SELF_METRICS_INTERVAL"`
+	DrainDelay            int     `env:"DRAIN_DELAY"`
 }
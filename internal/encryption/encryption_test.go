@@ -0,0 +1,73 @@
+package encryption_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/internal/encryption"
+)
+
+func writeKeys(t *testing.T) (string, string) {
+	t.Helper()
+	privPEM, pubPEM, err := encryption.GenerateKey(2048)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	privPath, pubPath := filepath.Join(dir, "private.pem"), filepath.Join(dir, "public.pem")
+	require.NoError(t, os.WriteFile(privPath, privPEM, 0600))
+	require.NoError(t, os.WriteFile(pubPath, pubPEM, 0644))
+	return privPath, pubPath
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	privPath, pubPath := writeKeys(t)
+	priv, err := encryption.LoadPrivateKey(privPath)
+	require.NoError(t, err)
+	pub, err := encryption.LoadPublicKey(pubPath)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		plaintext []byte
+	}{
+		{name: "empty body test", plaintext: nil},
+		{name: "json body test", plaintext: []byte(`[{"id": "test", "type": "gauge", "value": 1.1}]`)},
+		{name: "large body test", plaintext: make([]byte, 1<<20)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := encryption.Encrypt(pub, test.plaintext)
+			require.NoError(t, err)
+			got, err := encryption.Decrypt(priv, msg)
+			require.NoError(t, err)
+			assert.Equal(t, test.plaintext, got)
+		})
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	privPath, pubPath := writeKeys(t)
+	otherPrivPath, _ := writeKeys(t)
+	priv, err := encryption.LoadPrivateKey(privPath)
+	require.NoError(t, err)
+	otherPriv, err := encryption.LoadPrivateKey(otherPrivPath)
+	require.NoError(t, err)
+	pub, err := encryption.LoadPublicKey(pubPath)
+	require.NoError(t, err)
+	msg, err := encryption.Encrypt(pub, []byte("payload"))
+	require.NoError(t, err)
+
+	tampered := append([]byte{}, msg...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	_, err = encryption.Decrypt(otherPriv, msg)
+	assert.Error(t, err, "wrong key")
+	_, err = encryption.Decrypt(priv, tampered)
+	assert.Error(t, err, "tampered ciphertext")
+	_, err = encryption.Decrypt(priv, msg[:10])
+	assert.Error(t, err, "truncated message")
+}
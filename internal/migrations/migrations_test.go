@@ -0,0 +1,80 @@
+package migrations_test
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/internal/migrations"
+)
+
+func TestLoad(t *testing.T) {
+	ms, err := migrations.Load()
+	require.NoError(t, err)
+	require.NotEmpty(t, ms)
+	for i, m := range ms {
+		assert.Equal(t, i+1, m.Version, "versions are consecutive")
+		assert.NotEmpty(t, m.Name)
+		assert.NotEmpty(t, m.Up)
+		assert.NotEmpty(t, m.Down)
+	}
+}
+
+// TestMigrate needs a disposable database in TEST_DATABASE_DSN.
+func TestMigrate(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	ctx := context.Background()
+	db, err := pgxpool.New(ctx, dsn)
+	require.NoError(t, err)
+	defer db.Close()
+	ms, err := migrations.Load()
+	require.NoError(t, err)
+
+	_, err = migrations.Down(ctx, db, len(ms))
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	applied := make([]int, 4)
+	for i := range applied {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := migrations.Up(ctx, db)
+			assert.NoError(t, err)
+			applied[i] = n
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, n := range applied {
+		total += n
+	}
+	assert.Equal(t, len(ms), total, "concurrent runs apply every migration once")
+
+	statuses, err := migrations.GetStatus(ctx, db)
+	require.NoError(t, err)
+	for _, s := range statuses {
+		assert.NotNil(t, s.AppliedAt)
+	}
+
+	n, err := migrations.Down(ctx, db, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	statuses, err = migrations.GetStatus(ctx, db)
+	require.NoError(t, err)
+	assert.Nil(t, statuses[len(statuses)-1].AppliedAt)
+
+	n, err = migrations.Up(ctx, db)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS counters (
+    name varchar PRIMARY KEY,
+    value bigint
+);
+
+CREATE TABLE IF NOT EXISTS gauges (
+    name varchar PRIMARY KEY,
+    value double precision
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id varchar PRIMARY KEY,
+    name varchar NOT NULL,
+    hash varchar NOT NULL UNIQUE,
+    scopes varchar NOT NULL,
+    created_at timestamptz NOT NULL,
+    revoked_at timestamptz
+);
@@ -1,8 +1,53 @@
 package models
 
+import "errors"
+
+var (
+	ErrInvalidType  = errors.New("provided metric type is incorrect")
+	ErrEmptyID      = errors.New("metric id is empty")
+	ErrMissingValue = errors.New("metric value is missing")
+	ErrNotFound     = errors.New("can't find metric by provided name")
+)
+
 type Metrics struct {
 	ID    string   `json:"id"`              // имя метрики
 	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
 	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
 	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
 }
+
+// Validate reports whether the metric can be stored: it must have a name,
+// a known type and the value field matching that type.
+func (m *Metrics) Validate() error {
+	if m.ID == "" {
+		return ErrEmptyID
+	}
+
+	switch m.MType {
+	case "counter":
+		if m.Delta == nil {
+			return ErrMissingValue
+		}
+	case "gauge":
+		if m.Value == nil {
+			return ErrMissingValue
+		}
+	default:
+		return ErrInvalidType
+	}
+
+	return nil
+}
+
+// RejectedMetric describes a batch item that was not stored.
+type RejectedMetric struct {
+	Index  int    `json:"index"`  // позиция метрики в исходном пакете
+	ID     string `json:"id"`     // имя метрики
+	Reason string `json:"reason"` // причина отказа
+}
+
+// BatchResult is the /updates/ response body when only part of a batch was accepted.
+type BatchResult struct {
+	Accepted []Metrics        `json:"accepted"`
+	Rejected []RejectedMetric `json:"rejected"`
+}
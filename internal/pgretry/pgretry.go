@@ -0,0 +1,151 @@
+// Package pgretry retries Postgres operations that failed for transient
+// reasons and stops calling the database for a while after repeated
+// failures.
+package pgretry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var ErrCircuitOpen = errors.New("database circuit breaker is open")
+
+// Delays between attempts, the first attempt runs immediately.
+var Delays = []time.Duration{time.Second, time.Second * 3, time.Second * 5}
+
+// Retryable reports whether err leaves the database unchanged and may go
+// away on its own: a failure before the query was sent, a connection
+// exception, a serialization failure or a deadlock.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgerrcode.IsConnectionException(pgErr.Code) ||
+			pgErr.Code == pgerrcode.SerializationFailure ||
+			pgErr.Code == pgerrcode.DeadlockDetected
+	}
+
+	return pgconn.SafeToRetry(err)
+}
+
+// unavailable reports whether err says something about the database health
+// rather than about the query.
+func unavailable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgerrcode.IsConnectionException(pgErr.Code)
+	}
+
+	var connErr *pgconn.ConnectError
+	return errors.As(err, &connErr) || pgconn.SafeToRetry(err) || pgconn.Timeout(err)
+}
+
+type State string
+
+const (
+	StateClosed   State = "closed"
+	StateOpen     State = "open"
+	StateHalfOpen State = "half-open"
+)
+
+// Breaker opens after threshold consecutive failed operations and lets a
+// single trial operation through once cooldown has passed.
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	delays    []time.Duration
+	failures  int
+	openedAt  time.Time
+	trial     bool
+}
+
+// NewBreaker returns a breaker that never opens when threshold is 0.
+// Retries wait for delays, or for Delays when none are given.
+func NewBreaker(threshold int, cooldown time.Duration, delays ...time.Duration) *Breaker {
+	if len(delays) == 0 {
+		delays = Delays
+	}
+
+	return &Breaker{threshold: threshold, cooldown: cooldown, delays: delays}
+}
+
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state()
+}
+
+func (b *Breaker) state() State {
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return StateClosed
+	}
+
+	if time.Since(b.openedAt) < b.cooldown {
+		return StateOpen
+	}
+
+	return StateHalfOpen
+}
+
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state() {
+	case StateClosed:
+		return true
+	case StateHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if err == nil || !unavailable(err) {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
+
+// Do runs fn, retrying it after retryable errors, unless the breaker is
+// open.
+func (b *Breaker) Do(ctx context.Context, fn func(context.Context) error) error {
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+
+	err := fn(ctx)
+	for i := 0; i < len(b.delays) && Retryable(err); i++ {
+		select {
+		case <-ctx.Done():
+			b.record(err)
+			return err
+		case <-time.After(b.delays[i]):
+		}
+		err = fn(ctx)
+	}
+
+	b.record(err)
+	return err
+}
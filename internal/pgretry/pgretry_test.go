@@ -0,0 +1,79 @@
+package pgretry_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vladkonst/metrics-alerting/internal/pgretry"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection exception test", err: &pgconn.PgError{Code: pgerrcode.ConnectionFailure}, want: true},
+		{name: "serialization failure test", err: &pgconn.PgError{Code: pgerrcode.SerializationFailure}, want: true},
+		{name: "deadlock test", err: &pgconn.PgError{Code: pgerrcode.DeadlockDetected}, want: true},
+		{name: "unique violation test", err: &pgconn.PgError{Code: pgerrcode.UniqueViolation}, want: false},
+		{name: "canceled test", err: context.Canceled, want: false},
+		{name: "other error test", err: errors.New("boom"), want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, pgretry.Retryable(test.err))
+		})
+	}
+}
+
+func TestBreakerRetries(t *testing.T) {
+	b := pgretry.NewBreaker(0, 0, time.Millisecond, time.Millisecond)
+	calls := 0
+	err := b.Do(context.Background(), func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return &pgconn.PgError{Code: pgerrcode.SerializationFailure}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = b.Do(context.Background(), func(context.Context) error {
+		calls++
+		return &pgconn.PgError{Code: pgerrcode.UniqueViolation}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls, "non retryable errors are returned at once")
+}
+
+func TestBreakerOpens(t *testing.T) {
+	b := pgretry.NewBreaker(2, 50*time.Millisecond, time.Millisecond)
+	down := func(context.Context) error { return &pgconn.PgError{Code: pgerrcode.ConnectionFailure} }
+	up := func(context.Context) error { return nil }
+	ctx := context.Background()
+
+	assert.Error(t, b.Do(ctx, down))
+	assert.Equal(t, pgretry.StateClosed, b.State())
+	assert.Error(t, b.Do(ctx, down))
+	assert.Equal(t, pgretry.StateOpen, b.State())
+	assert.ErrorIs(t, b.Do(ctx, up), pgretry.ErrCircuitOpen)
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, pgretry.StateHalfOpen, b.State())
+	assert.Error(t, b.Do(ctx, down))
+	assert.Equal(t, pgretry.StateOpen, b.State(), "a failed trial opens the breaker again")
+
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, b.Do(ctx, up))
+	assert.Equal(t, pgretry.StateClosed, b.State())
+}
@@ -0,0 +1,14 @@
+// Package signing defines what the agent signs and the server verifies, so
+// both sides build the signed bytes the same way.
+package signing
+
+// Material is what a request carrying a timestamp and a nonce is signed
+// over, so neither can be changed without invalidating the signature.
+func Material(ts, nonce string, body []byte) []byte {
+	b := make([]byte, 0, len(ts)+len(nonce)+len(body)+2)
+	b = append(b, ts...)
+	b = append(b, '\n')
+	b = append(b, nonce...)
+	b = append(b, '\n')
+	return append(b, body...)
+}
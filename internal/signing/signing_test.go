@@ -0,0 +1,14 @@
+package signing_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vladkonst/metrics-alerting/internal/signing"
+)
+
+func TestMaterial(t *testing.T) {
+	assert.Equal(t, "1700000000\nabc\n[]", string(signing.Material("1700000000", "abc", []byte("[]"))))
+	assert.Equal(t, "\n\n", string(signing.Material("", "", nil)))
+}
@@ -0,0 +1,361 @@
+package storage
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/vladkonst/metrics-alerting/internal/models"
+)
+
+var (
+	gaugesBucket   = []byte("gauges")
+	countersBucket = []byte("counters")
+)
+
+// BoltStorage keeps metrics in a bbolt file. Every write is a transaction
+// synced to disk before it returns, so no snapshots are needed.
+type BoltStorage struct {
+	db *bolt.DB
+}
+
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{gaugesBucket, countersBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStorage{db: db}, nil
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
+
+// Ping checks that the database file is open and readable.
+func (s *BoltStorage) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(gaugesBucket) == nil || tx.Bucket(countersBucket) == nil {
+			return errors.New("metric buckets are missing")
+		}
+		return nil
+	})
+}
+
+func encodeValue(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// putMetric stores the metric and returns the result and the value it
+// replaced, nil when the series is new.
+func putMetric(tx *bolt.Tx, metric *models.Metrics) (*models.Metrics, *models.Metrics, error) {
+	key := []byte(metric.ID)
+	var b *bolt.Bucket
+	switch metric.MType {
+	case "counter":
+		b = tx.Bucket(countersBucket)
+	case "gauge":
+		b = tx.Bucket(gaugesBucket)
+	default:
+		return nil, nil, models.ErrInvalidType
+	}
+
+	var prev *models.Metrics
+	old := b.Get(key)
+	if old != nil {
+		prev = decodeMetric(metric, binary.BigEndian.Uint64(old))
+	}
+
+	if metric.MType == "counter" {
+		v := *metric.Delta
+		if prev != nil {
+			v += *prev.Delta
+		}
+		if err := b.Put(key, encodeValue(uint64(v))); err != nil {
+			return nil, nil, err
+		}
+		return &models.Metrics{ID: metric.ID, MType: metric.MType, Delta: &v}, prev, nil
+	}
+
+	v := *metric.Value
+	if err := b.Put(key, encodeValue(math.Float64bits(v))); err != nil {
+		return nil, nil, err
+	}
+	return &models.Metrics{ID: metric.ID, MType: metric.MType, Value: &v}, prev, nil
+}
+
+func decodeMetric(metric *models.Metrics, raw uint64) *models.Metrics {
+	found := &models.Metrics{ID: metric.ID, MType: metric.MType}
+	if metric.MType == "counter" {
+		d := int64(raw)
+		found.Delta = &d
+	} else {
+		v := math.Float64frombits(raw)
+		found.Value = &v
+	}
+	return found
+}
+
+func (s *BoltStorage) AddMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
+	stored, _, err := s.SwapMetrics(ctx, metrics)
+	return stored, err
+}
+
+// SwapMetrics stores the batch in one transaction like AddMetrics and
+// returns the values the series had before it.
+func (s *BoltStorage) SwapMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, map[string]*models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	stored := make([]models.Metrics, 0, len(metrics))
+	previous := make(map[string]*models.Metrics, len(metrics))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, metric := range metrics {
+			m, prev, err := putMetric(tx, &metric)
+			if err != nil {
+				return err
+			}
+			k := seriesKey(&metric)
+			if _, ok := previous[k]; !ok {
+				previous[k] = prev
+			}
+			stored = append(stored, *m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return stored, previous, nil
+}
+
+func (s *BoltStorage) AddMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var stored *models.Metrics
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		stored, _, err = putMetric(tx, metric)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+func (s *BoltStorage) GetMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var bucket []byte
+	switch metric.MType {
+	case "counter":
+		bucket = countersBucket
+	case "gauge":
+		bucket = gaugesBucket
+	default:
+		return nil, models.ErrInvalidType
+	}
+
+	var raw uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucket).Get([]byte(metric.ID))
+		if v == nil {
+			return models.ErrNotFound
+		}
+		raw = binary.BigEndian.Uint64(v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeMetric(metric, raw), nil
+}
+
+func (s *BoltStorage) GetCountersValues(ctx context.Context) (map[string]int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	counters := make(map[string]int64)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(countersBucket).ForEach(func(k, v []byte) error {
+			counters[string(k)] = int64(binary.BigEndian.Uint64(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return counters, nil
+}
+
+func (s *BoltStorage) GetGaugesValues(ctx context.Context) (map[string]float64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	gauges := make(map[string]float64)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(gaugesBucket).ForEach(func(k, v []byte) error {
+			gauges[string(k)] = math.Float64frombits(binary.BigEndian.Uint64(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return gauges, nil
+}
+
+// Snapshot reads every series in a single transaction.
+func (s *BoltStorage) Snapshot(ctx context.Context) ([]models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	metrics := make([]models.Metrics, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket(gaugesBucket).ForEach(func(k, v []byte) error {
+			g := math.Float64frombits(binary.BigEndian.Uint64(v))
+			metrics = append(metrics, models.Metrics{ID: string(k), MType: "gauge", Value: &g})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(countersBucket).ForEach(func(k, v []byte) error {
+			d := int64(binary.BigEndian.Uint64(v))
+			metrics = append(metrics, models.Metrics{ID: string(k), MType: "counter", Delta: &d})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return metrics, nil
+}
+
+// ReadSeries returns up to limit series ordered by seriesKey, starting after
+// the series with the key after, so Copy can read the file a page at a time.
+func (s *BoltStorage) ReadSeries(ctx context.Context, after string, limit int) ([]models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	afterType, afterID, _ := strings.Cut(after, ":")
+	metrics := make([]models.Metrics, 0, limit)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, b := range []struct {
+			mtype  string
+			bucket []byte
+		}{{"counter", countersBucket}, {"gauge", gaugesBucket}} {
+			if b.mtype < afterType {
+				continue
+			}
+
+			c := tx.Bucket(b.bucket).Cursor()
+			k, v := c.First()
+			if b.mtype == afterType {
+				k, v = c.Seek([]byte(afterID))
+				if k != nil && string(k) == afterID {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && len(metrics) < limit; k, v = c.Next() {
+				metrics = append(metrics, *decodeMetric(&models.Metrics{ID: string(k), MType: b.mtype}, binary.BigEndian.Uint64(v)))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return metrics, nil
+}
+
+// Reset recreates the buckets in a single transaction.
+func (s *BoltStorage) Reset(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(resetBuckets)
+}
+
+// ReplaceMetrics recreates the buckets and stores the batch in a single
+// transaction.
+func (s *BoltStorage) ReplaceMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stored := make([]models.Metrics, 0, len(metrics))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := resetBuckets(tx); err != nil {
+			return err
+		}
+		for _, metric := range metrics {
+			m, _, err := putMetric(tx, &metric)
+			if err != nil {
+				return err
+			}
+			stored = append(stored, *m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+func resetBuckets(tx *bolt.Tx) error {
+	for _, name := range [][]byte{gaugesBucket, countersBucket} {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package storage_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/storage"
+	"github.com/vladkonst/metrics-alerting/internal/storage/storagetest"
+)
+
+func TestBoltStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) handlers.MetricRepository {
+		s, err := storage.NewBoltStorage(filepath.Join(t.TempDir(), "metrics.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	}, storagetest.Options{})
+}
+
+func TestBoltStorageReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	ctx := context.Background()
+	s, err := storage.NewBoltStorage(path)
+	require.NoError(t, err)
+	_, err = s.AddMetrics(ctx, []models.Metrics{storagetest.Counter("c", 2), storagetest.Gauge("g", 0.25)})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	s, err = storage.NewBoltStorage(path)
+	require.NoError(t, err)
+	defer s.Close()
+	stored, err := s.AddMetric(ctx, &models.Metrics{ID: "c", MType: "counter", Delta: new(int64)})
+	require.NoError(t, err)
+	assert.Equal(t, storagetest.Counter("c", 2), *stored)
+	gauges, err := s.GetGaugesValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"g": 0.25}, gauges)
+}
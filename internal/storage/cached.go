@@ -0,0 +1,460 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/logger"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+)
+
+// Notifier tells the other replicas sharing a backend which series changed.
+type Notifier interface {
+	// Notify with nil keys asks the other replicas to reload everything.
+	Notify(ctx context.Context, keys []string) error
+	// Listen calls fn with the keys changed by other replicas until ctx is
+	// done. A nil slice means notifications may have been missed and
+	// everything must be reloaded.
+	Listen(ctx context.Context, fn func(keys []string)) error
+}
+
+// CachedStorage serves reads from memory and writes to the backend either
+// right away or, with a flush interval, in batches that merge all updates
+// of a series received in between. Writes through the cache are serialized
+// so it always holds the latest backend value.
+type CachedStorage struct {
+	backend  handlers.MetricRepository
+	cache    *MemStorage
+	notifier Notifier
+	interval time.Duration
+
+	// flushMu serializes flushes and write-through writes with reloads from
+	// the backend, so a reload never sees a half-written flush or caches a
+	// value older than a write that finished during it.
+	flushMu sync.Mutex
+	// mu guards the pending updates together with the cache.
+	mu       sync.Mutex
+	counters map[string]int64
+	gauges   map[string]float64
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewCachedStorage loads all metrics from the backend. A zero interval
+// writes through, notifier may be nil with a single replica.
+func NewCachedStorage(backend handlers.MetricRepository, interval time.Duration, notifier Notifier) (*CachedStorage, error) {
+	ch := make(chan models.Metrics)
+	c := &CachedStorage{
+		backend:  backend,
+		cache:    NewMemStorage(&ch),
+		notifier: notifier,
+		interval: interval,
+		counters: make(map[string]int64),
+		gauges:   make(map[string]float64),
+	}
+
+	if err := c.reload(context.Background(), nil); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	if interval > 0 {
+		c.wg.Add(1)
+		go c.flushLoop(ctx)
+	}
+
+	if notifier != nil {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			log := logger.Get()
+			err := notifier.Listen(ctx, func(keys []string) {
+				if err := c.reload(ctx, keys); err != nil {
+					log.Error().Err(err).Msg("failed to reload invalidated metrics")
+				}
+			})
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Error().Err(err).Msg("stopped listening for metric invalidations")
+			}
+		}()
+	}
+
+	return c, nil
+}
+
+// Close stops the background work and flushes pending updates.
+func (c *CachedStorage) Close() error {
+	c.cancel()
+	c.wg.Wait()
+	return c.Flush(context.Background())
+}
+
+func (c *CachedStorage) flushLoop(ctx context.Context) {
+	defer c.wg.Done()
+	log := logger.Get()
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := c.Flush(ctx); err != nil {
+				log.Error().Err(err).Msg("failed to flush cached metrics")
+			}
+		}
+	}
+}
+
+// Flush writes the pending updates to the backend. They are kept for the
+// next flush when the backend fails.
+func (c *CachedStorage) Flush(ctx context.Context) error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	counters, gauges := c.counters, c.gauges
+	c.counters, c.gauges = make(map[string]int64), make(map[string]float64)
+	c.mu.Unlock()
+	if len(counters) == 0 && len(gauges) == 0 {
+		return nil
+	}
+
+	batch := make([]models.Metrics, 0, len(counters)+len(gauges))
+	for id, d := range counters {
+		batch = append(batch, models.Metrics{ID: id, MType: "counter", Delta: &d})
+	}
+	for id, v := range gauges {
+		batch = append(batch, models.Metrics{ID: id, MType: "gauge", Value: &v})
+	}
+
+	if _, err := c.backend.AddMetrics(ctx, batch); err != nil {
+		c.mu.Lock()
+		for id, d := range counters {
+			c.counters[id] += d
+		}
+		for id, v := range gauges {
+			if _, ok := c.gauges[id]; !ok {
+				c.gauges[id] = v
+			}
+		}
+		c.mu.Unlock()
+		return err
+	}
+
+	c.notify(ctx, batch)
+	return nil
+}
+
+// notify only logs failures because the write itself has succeeded.
+func (c *CachedStorage) notify(ctx context.Context, metrics []models.Metrics) {
+	if c.notifier == nil {
+		return
+	}
+
+	keys := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		keys = append(keys, seriesKey(&m))
+	}
+	if err := c.notifier.Notify(ctx, keys); err != nil {
+		log := logger.Get()
+		log.Error().Err(err).Msg("failed to notify replicas about changed metrics")
+	}
+}
+
+// reload replaces the cached values of keys, or of every metric when keys
+// is nil, with the backend values plus the updates not flushed yet.
+func (c *CachedStorage) reload(ctx context.Context, keys []string) error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	fresh := make([]models.Metrics, 0, len(keys))
+	if keys == nil {
+		gauges, err := c.backend.GetGaugesValues(ctx)
+		if err != nil {
+			return err
+		}
+		counters, err := c.backend.GetCountersValues(ctx)
+		if err != nil {
+			return err
+		}
+		for id, v := range gauges {
+			fresh = append(fresh, models.Metrics{ID: id, MType: "gauge", Value: &v})
+		}
+		for id, d := range counters {
+			fresh = append(fresh, models.Metrics{ID: id, MType: "counter", Delta: &d})
+		}
+	}
+
+	for _, k := range keys {
+		mtype, id, _ := strings.Cut(k, ":")
+		m, err := c.backend.GetMetric(ctx, &models.Metrics{ID: id, MType: mtype})
+		if err != nil {
+			continue
+		}
+		fresh = append(fresh, *m)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if keys == nil {
+		// Series removed from the backend must disappear from the cache,
+		// except for the ones still waiting to be flushed.
+		if err := c.cache.Reset(ctx); err != nil {
+			return err
+		}
+		for id, d := range c.counters {
+			c.cache.set(&models.Metrics{ID: id, MType: "counter", Delta: &d})
+		}
+		for id, v := range c.gauges {
+			c.cache.set(&models.Metrics{ID: id, MType: "gauge", Value: &v})
+		}
+	}
+
+	for _, m := range fresh {
+		switch m.MType {
+		case "counter":
+			d := *m.Delta + c.counters[m.ID]
+			m.Delta = &d
+		case "gauge":
+			if _, ok := c.gauges[m.ID]; ok {
+				continue
+			}
+		}
+		c.cache.set(&m)
+	}
+	return nil
+}
+
+func (c *CachedStorage) AddMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
+	if c.interval == 0 {
+		stored, err := c.writeThrough(func() ([]models.Metrics, error) {
+			return c.backend.AddMetrics(ctx, metrics)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		c.notify(ctx, stored)
+		return stored, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stored, err := c.cache.AddMetrics(ctx, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range metrics {
+		c.pend(&m)
+	}
+	return stored, nil
+}
+
+// SwapMetrics returns the replaced values from the cache, or from the
+// backend when writing through.
+func (c *CachedStorage) SwapMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, map[string]*models.Metrics, error) {
+	if c.interval == 0 {
+		sw, ok := c.backend.(handlers.Swapper)
+		if !ok {
+			return nil, nil, errors.ErrUnsupported
+		}
+
+		var previous map[string]*models.Metrics
+		stored, err := c.writeThrough(func() ([]models.Metrics, error) {
+			var stored []models.Metrics
+			var err error
+			stored, previous, err = sw.SwapMetrics(ctx, metrics)
+			return stored, err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		c.notify(ctx, stored)
+		return stored, previous, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stored, previous, err := c.cache.SwapMetrics(ctx, metrics)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, m := range metrics {
+		c.pend(&m)
+	}
+	return stored, previous, nil
+}
+
+func (c *CachedStorage) AddMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	if c.interval == 0 {
+		stored, err := c.writeThrough(func() ([]models.Metrics, error) {
+			m, err := c.backend.AddMetric(ctx, metric)
+			if err != nil {
+				return nil, err
+			}
+			return []models.Metrics{*m}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		c.notify(ctx, stored)
+		return &stored[0], nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stored, err := c.cache.AddMetric(ctx, metric)
+	if err != nil {
+		return nil, err
+	}
+
+	c.pend(metric)
+	return stored, nil
+}
+
+// writeThrough runs the backend write and caches its result under the lock,
+// so concurrent writes reach the cache in the order they were stored. It
+// holds flushMu too, or a reload that read the backend before the write
+// would put the older value back into the cache.
+func (c *CachedStorage) writeThrough(write func() ([]models.Metrics, error)) ([]models.Metrics, error) {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stored, err := write()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range stored {
+		c.cache.set(&m)
+	}
+	return stored, nil
+}
+
+func (c *CachedStorage) pend(metric *models.Metrics) {
+	if metric.MType == "counter" {
+		c.counters[metric.ID] += *metric.Delta
+	} else {
+		c.gauges[metric.ID] = *metric.Value
+	}
+}
+
+// GetMetric falls back to the backend for series the cache hasn't seen.
+func (c *CachedStorage) GetMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	if m, err := c.cache.GetMetric(ctx, metric); err == nil {
+		return m, nil
+	}
+
+	m, err := c.backend.GetMetric(ctx, metric)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, err := c.cache.GetMetric(ctx, m); err == nil {
+		return cached, nil
+	}
+	c.cache.set(m)
+	return m, nil
+}
+
+func (c *CachedStorage) GetGaugesValues(ctx context.Context) (map[string]float64, error) {
+	return c.cache.GetGaugesValues(ctx)
+}
+
+func (c *CachedStorage) GetCountersValues(ctx context.Context) (map[string]int64, error) {
+	return c.cache.GetCountersValues(ctx)
+}
+
+// Ping checks the backend when it can be checked.
+func (c *CachedStorage) Ping(ctx context.Context) error {
+	if p, ok := c.backend.(handlers.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *CachedStorage) Snapshot(ctx context.Context) ([]models.Metrics, error) {
+	return c.cache.Snapshot(ctx)
+}
+
+// ReplaceMetrics replaces every series in the backend and, once that
+// succeeded, drops the pending updates and replaces the cache, then tells
+// the other replicas to reload everything.
+func (c *CachedStorage) ReplaceMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
+	r, ok := c.backend.(handlers.Replacer)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	c.flushMu.Lock()
+	c.mu.Lock()
+	stored, err := r.ReplaceMetrics(ctx, metrics)
+	if err == nil {
+		c.counters, c.gauges = make(map[string]int64), make(map[string]float64)
+		// Counters are stored as running totals, so only the last value
+		// of each series goes into the empty cache.
+		last := bySeries(stored)
+		final := make([]models.Metrics, 0, len(last))
+		for _, m := range last {
+			final = append(final, m)
+		}
+		_, err = c.cache.ReplaceMetrics(ctx, final)
+	}
+	c.mu.Unlock()
+	c.flushMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.notifier != nil {
+		if err := c.notifier.Notify(ctx, nil); err != nil {
+			log := logger.Get()
+			log.Error().Err(err).Msg("failed to notify replicas about replaced metrics")
+		}
+	}
+	return stored, nil
+}
+
+// Reset drops the pending updates and removes every series from the cache
+// and the backend, then tells the other replicas to reload everything.
+func (c *CachedStorage) Reset(ctx context.Context) error {
+	r, ok := c.backend.(handlers.Resetter)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+
+	c.flushMu.Lock()
+	c.mu.Lock()
+	c.counters, c.gauges = make(map[string]int64), make(map[string]float64)
+	err := r.Reset(ctx)
+	if err == nil {
+		err = c.cache.Reset(ctx)
+	}
+	c.mu.Unlock()
+	c.flushMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if c.notifier != nil {
+		if err := c.notifier.Notify(ctx, nil); err != nil {
+			log := logger.Get()
+			log.Error().Err(err).Msg("failed to notify replicas about reset metrics")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package storage_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/storage"
+	"github.com/vladkonst/metrics-alerting/internal/storage/storagetest"
+)
+
+func newCachedStorage(t *testing.T, backend handlers.MetricRepository, interval time.Duration, n storage.Notifier) *storage.CachedStorage {
+	c, err := storage.NewCachedStorage(backend, interval, n)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestCachedStorage(t *testing.T) {
+	for name, interval := range map[string]time.Duration{"write-through": 0, "write-behind": 5 * time.Millisecond} {
+		t.Run(name, func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T) handlers.MetricRepository {
+				return newCachedStorage(t, newMemStorage(), interval, nil)
+			}, storagetest.Options{})
+		})
+	}
+}
+
+// countingStorage counts the writes reaching the backend.
+type countingStorage struct {
+	*storage.MemStorage
+	writes atomic.Int64
+}
+
+func (s *countingStorage) AddMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
+	s.writes.Add(1)
+	return s.MemStorage.AddMetrics(ctx, metrics)
+}
+
+func (s *countingStorage) AddMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	s.writes.Add(1)
+	return s.MemStorage.AddMetric(ctx, metric)
+}
+
+func TestCachedStorageCoalescesWrites(t *testing.T) {
+	backend := &countingStorage{MemStorage: newMemStorage()}
+	ctx := context.Background()
+	one := storagetest.Counter("c", 5)
+	_, err := backend.MemStorage.AddMetric(ctx, &one)
+	require.NoError(t, err)
+
+	c := newCachedStorage(t, backend, time.Hour, nil)
+	for i := 1; i <= 100; i++ {
+		m := storagetest.Counter("c", 1)
+		stored, err := c.AddMetric(ctx, &m)
+		require.NoError(t, err)
+		assert.Equal(t, int64(5+i), *stored.Delta)
+		g := storagetest.Gauge("g", float64(i))
+		_, err = c.AddMetric(ctx, &g)
+		require.NoError(t, err)
+	}
+	assert.Zero(t, backend.writes.Load())
+
+	require.NoError(t, c.Flush(ctx))
+	assert.Equal(t, int64(1), backend.writes.Load())
+	counters, err := backend.GetCountersValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"c": 105}, counters)
+	gauges, err := backend.GetGaugesValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"g": 100}, gauges)
+}
+
+// bus delivers notifications between replicas in the same process.
+type bus struct {
+	mu        sync.Mutex
+	listeners map[string]func([]string)
+}
+
+type busNotifier struct {
+	bus     *bus
+	replica string
+}
+
+func (n busNotifier) Notify(ctx context.Context, keys []string) error {
+	n.bus.mu.Lock()
+	defer n.bus.mu.Unlock()
+	for replica, fn := range n.bus.listeners {
+		if replica != n.replica {
+			fn(keys)
+		}
+	}
+	return nil
+}
+
+func (n busNotifier) Listen(ctx context.Context, fn func([]string)) error {
+	n.bus.mu.Lock()
+	n.bus.listeners[n.replica] = fn
+	n.bus.mu.Unlock()
+	<-ctx.Done()
+	n.bus.mu.Lock()
+	delete(n.bus.listeners, n.replica)
+	n.bus.mu.Unlock()
+	return ctx.Err()
+}
+
+func TestCachedStorageInvalidation(t *testing.T) {
+	for name, interval := range map[string]time.Duration{"write-through": 0, "write-behind": 5 * time.Millisecond} {
+		t.Run(name, func(t *testing.T) {
+			backend := newMemStorage()
+			b := &bus{listeners: make(map[string]func([]string))}
+			first := newCachedStorage(t, backend, interval, busNotifier{bus: b, replica: "first"})
+			second := newCachedStorage(t, backend, interval, busNotifier{bus: b, replica: "second"})
+			ctx := context.Background()
+			read := func(s *storage.CachedStorage) int64 {
+				m, err := s.GetMetric(ctx, &models.Metrics{ID: "c", MType: "counter"})
+				if err != nil {
+					return 0
+				}
+				return *m.Delta
+			}
+
+			one := storagetest.Counter("c", 1)
+			_, err := first.AddMetric(ctx, &one)
+			require.NoError(t, err)
+			assert.Eventually(t, func() bool { return read(second) == 1 }, time.Second, time.Millisecond)
+
+			two := storagetest.Counter("c", 2)
+			_, err = second.AddMetric(ctx, &two)
+			require.NoError(t, err)
+			assert.Eventually(t, func() bool { return read(first) == 3 }, time.Second, time.Millisecond)
+			assert.Equal(t, int64(3), read(second))
+
+			require.NoError(t, first.Flush(ctx))
+			require.NoError(t, second.Flush(ctx))
+			require.NoError(t, first.Reset(ctx))
+			counters, err := second.GetCountersValues(ctx)
+			require.NoError(t, err)
+			assert.Empty(t, counters)
+		})
+	}
+}
+
+// slowReadStorage blocks GetMetric after reading the backend value until
+// release is closed.
+type slowReadStorage struct {
+	*storage.MemStorage
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *slowReadStorage) GetMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	m, err := s.MemStorage.GetMetric(ctx, metric)
+	close(s.reading)
+	<-s.release
+	return m, err
+}
+
+func TestCachedStorageReloadDuringWriteThrough(t *testing.T) {
+	backend := &slowReadStorage{MemStorage: newMemStorage(), reading: make(chan struct{}), release: make(chan struct{})}
+	ctx := context.Background()
+	one := storagetest.Gauge("g", 1)
+	_, err := backend.MemStorage.AddMetric(ctx, &one)
+	require.NoError(t, err)
+
+	b := &bus{listeners: make(map[string]func([]string))}
+	c := newCachedStorage(t, backend, 0, busNotifier{bus: b, replica: "cache"})
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.listeners) == 1
+	}, time.Second, time.Millisecond)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		busNotifier{bus: b, replica: "other"}.Notify(ctx, []string{"gauge:g"})
+	}()
+	<-backend.reading
+
+	go func() {
+		defer wg.Done()
+		two := storagetest.Gauge("g", 2)
+		_, err := c.AddMetrics(ctx, []models.Metrics{two})
+		assert.NoError(t, err)
+	}()
+	// Give the write the chance to finish while the reload holds the
+	// value it read before.
+	time.Sleep(20 * time.Millisecond)
+	close(backend.release)
+	wg.Wait()
+
+	gauges, err := c.GetGaugesValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"g": 2}, gauges)
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+)
+
+// CopyOptions controls Copy.
+type CopyOptions struct {
+	// BatchSize is the number of series read per page and written per
+	// AddMetrics call.
+	BatchSize int
+	// DryRun only compares the storages.
+	DryRun bool
+	// Progress is called after every batch with the number of series
+	// processed so far.
+	Progress func(done int)
+}
+
+// CopyReport counts series by what Copy did to them.
+type CopyReport struct {
+	Total     int
+	Created   int
+	Updated   int
+	Unchanged int
+	// Verified and Mismatched are the result of reading the destination
+	// back after the copy. They stay zero on a dry run.
+	Verified   int
+	Mismatched []string
+}
+
+// SeriesReader is implemented by storages that can read their series a page
+// at a time. Copy reads other storages whole.
+type SeriesReader interface {
+	// ReadSeries returns up to limit series ordered by type and name,
+	// starting after the series with the key after, "type:name".
+	ReadSeries(ctx context.Context, after string, limit int) ([]models.Metrics, error)
+}
+
+// Copy makes every series of from have the same value in to. Counters are
+// written as the difference to the destination value, so copying into a
+// storage that already has some of the series doesn't add them up twice.
+// There is no metric history to copy, only current values.
+//
+// Both storages are read in pages of BatchSize series walked side by side,
+// and read again to verify the copy.
+func Copy(ctx context.Context, from, to handlers.MetricRepository, opts CopyOptions) (*CopyReport, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+
+	src := newSeriesCursor(ctx, from, opts.BatchSize)
+	dst := newSeriesCursor(ctx, to, opts.BatchSize)
+	report := &CopyReport{}
+	batch := make([]models.Metrics, 0, opts.BatchSize)
+	flush := func() error {
+		if len(batch) > 0 && !opts.DryRun {
+			if _, err := to.AddMetrics(ctx, batch); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		if opts.Progress != nil {
+			opts.Progress(report.Total)
+		}
+		return nil
+	}
+
+	for {
+		m, err := src.next()
+		if err != nil {
+			return report, fmt.Errorf("read source: %w", err)
+		}
+		if m == nil {
+			break
+		}
+
+		report.Total++
+		old, err := dst.find(seriesKey(m))
+		if err != nil {
+			return report, fmt.Errorf("read destination: %w", err)
+		}
+
+		switch {
+		case old == nil:
+			report.Created++
+			batch = append(batch, *m)
+		case sameValue(old, m):
+			report.Unchanged++
+		default:
+			report.Updated++
+			w := *m
+			if w.MType == "counter" {
+				d := *m.Delta - *old.Delta
+				w.Delta = &d
+			}
+			batch = append(batch, w)
+		}
+
+		if len(batch) == opts.BatchSize {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return report, err
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	src = newSeriesCursor(ctx, from, opts.BatchSize)
+	dst = newSeriesCursor(ctx, to, opts.BatchSize)
+	for {
+		m, err := src.next()
+		if err != nil {
+			return report, fmt.Errorf("read source: %w", err)
+		}
+		if m == nil {
+			return report, nil
+		}
+
+		got, err := dst.find(seriesKey(m))
+		if err != nil {
+			return report, fmt.Errorf("verify destination: %w", err)
+		}
+		if got != nil && sameValue(got, m) {
+			report.Verified++
+		} else {
+			report.Mismatched = append(report.Mismatched, seriesKey(m))
+		}
+	}
+}
+
+// seriesCursor walks the series of a storage in seriesKey order.
+type seriesCursor struct {
+	read func(after string) ([]models.Metrics, error)
+	page []models.Metrics
+	last string
+	done bool
+}
+
+func newSeriesCursor(ctx context.Context, s handlers.MetricRepository, size int) *seriesCursor {
+	if r, ok := s.(SeriesReader); ok {
+		return &seriesCursor{read: func(after string) ([]models.Metrics, error) {
+			return r.ReadSeries(ctx, after, size)
+		}}
+	}
+
+	c := &seriesCursor{}
+	c.read = func(string) ([]models.Metrics, error) {
+		c.done = true
+		return allMetrics(ctx, s)
+	}
+	return c
+}
+
+// fill reads the next page once the current one is used up and reports
+// whether there are series left.
+func (c *seriesCursor) fill() (bool, error) {
+	if len(c.page) > 0 {
+		return true, nil
+	}
+	if c.done {
+		return false, nil
+	}
+
+	page, err := c.read(c.last)
+	if err != nil {
+		return false, err
+	}
+	if len(page) == 0 {
+		c.done = true
+		return false, nil
+	}
+
+	c.page = page
+	c.last = seriesKey(&page[len(page)-1])
+	return true, nil
+}
+
+// next returns the next series, nil after the last one.
+func (c *seriesCursor) next() (*models.Metrics, error) {
+	if ok, err := c.fill(); !ok {
+		return nil, err
+	}
+
+	m := &c.page[0]
+	c.page = c.page[1:]
+	return m, nil
+}
+
+// find returns the series with the given key, or nil, skipping the series
+// ordered before it. Keys must be asked for in increasing order.
+func (c *seriesCursor) find(key string) (*models.Metrics, error) {
+	for {
+		if ok, err := c.fill(); !ok {
+			return nil, err
+		}
+
+		switch k := seriesKey(&c.page[0]); {
+		case k == key:
+			return &c.page[0], nil
+		case k > key:
+			return nil, nil
+		}
+		c.page = c.page[1:]
+	}
+}
+
+// allMetrics returns every series ordered by type and name.
+func allMetrics(ctx context.Context, s handlers.MetricRepository) ([]models.Metrics, error) {
+	gauges, err := s.GetGaugesValues(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	counters, err := s.GetCountersValues(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := make([]models.Metrics, 0, len(gauges)+len(counters))
+	for id, d := range counters {
+		metrics = append(metrics, models.Metrics{ID: id, MType: "counter", Delta: &d})
+	}
+	for id, v := range gauges {
+		metrics = append(metrics, models.Metrics{ID: id, MType: "gauge", Value: &v})
+	}
+
+	sort.Slice(metrics, func(i, j int) bool { return seriesKey(&metrics[i]) < seriesKey(&metrics[j]) })
+	return metrics, nil
+}
+
+func bySeries(metrics []models.Metrics) map[string]models.Metrics {
+	m := make(map[string]models.Metrics, len(metrics))
+	for _, metric := range metrics {
+		m[seriesKey(&metric)] = metric
+	}
+	return m
+}
+
+func sameValue(a, b *models.Metrics) bool {
+	if a.MType == "counter" {
+		return *a.Delta == *b.Delta
+	}
+	return *a.Value == *b.Value
+}
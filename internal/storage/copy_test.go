@@ -0,0 +1,123 @@
+package storage_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/storage"
+	"github.com/vladkonst/metrics-alerting/internal/storage/storagetest"
+)
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	fill := func(metrics ...models.Metrics) *storage.MemStorage {
+		s := newMemStorage()
+		_, err := s.AddMetrics(ctx, metrics)
+		require.NoError(t, err)
+		return s
+	}
+
+	tests := []struct {
+		name   string
+		dryRun bool
+		want   storage.CopyReport
+		counts map[string]int64
+	}{
+		{
+			name:   "copy test",
+			want:   storage.CopyReport{Total: 4, Created: 2, Updated: 1, Unchanged: 1, Verified: 4},
+			counts: map[string]int64{"a": 10, "b": 3, "old": 1},
+		},
+		{
+			name:   "dry run test",
+			dryRun: true,
+			want:   storage.CopyReport{Total: 4, Created: 2, Updated: 1, Unchanged: 1},
+			counts: map[string]int64{"a": 4, "old": 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			from := fill(storagetest.Counter("a", 10), storagetest.Counter("b", 3), storagetest.Gauge("g", 1.5), storagetest.Gauge("h", 2))
+			to := fill(storagetest.Counter("a", 4), storagetest.Gauge("g", 1.5), storagetest.Counter("old", 1))
+			progress := 0
+			report, err := storage.Copy(ctx, from, to, storage.CopyOptions{BatchSize: 1, DryRun: test.dryRun, Progress: func(done int) {
+				progress = done
+			}})
+			require.NoError(t, err)
+			assert.Equal(t, test.want, *report)
+			assert.Equal(t, 4, progress)
+
+			counters, err := to.GetCountersValues(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, test.counts, counters)
+		})
+	}
+}
+
+func TestCopyPages(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	fill := func(name string, metrics ...models.Metrics) *storage.BoltStorage {
+		s, err := storage.NewBoltStorage(filepath.Join(dir, name))
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		_, err = s.AddMetrics(ctx, metrics)
+		require.NoError(t, err)
+		return s
+	}
+
+	from := fill("from.db", storagetest.Counter("a", 10), storagetest.Counter("b", 3), storagetest.Counter("zz", 1),
+		storagetest.Gauge("a", 1), storagetest.Gauge("g", 1.5), storagetest.Gauge("h", 2))
+	to := fill("to.db", storagetest.Counter("a", 4), storagetest.Counter("b", 3), storagetest.Counter("old", 1),
+		storagetest.Gauge("g", 1.5), storagetest.Gauge("y", 5))
+	report, err := storage.Copy(ctx, from, to, storage.CopyOptions{BatchSize: 2})
+	require.NoError(t, err)
+	assert.Equal(t, storage.CopyReport{Total: 6, Created: 3, Updated: 1, Unchanged: 2, Verified: 6}, *report)
+
+	counters, err := to.GetCountersValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"a": 10, "b": 3, "old": 1, "zz": 1}, counters)
+	gauges, err := to.GetGaugesValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"a": 1, "g": 1.5, "h": 2, "y": 5}, gauges)
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	snapshot(t, filepath.Join(dir, "metrics.txt"), storage.SnapshotOptions{}, map[string]float64{"g": 3})
+
+	from, fromCloser, err := storage.Open(ctx, "file:"+filepath.Join(dir, "metrics.txt"), storage.OpenOptions{})
+	require.NoError(t, err)
+	to, toCloser, err := storage.Open(ctx, "embedded:"+filepath.Join(dir, "metrics.db"), storage.OpenOptions{})
+	require.NoError(t, err)
+	report, err := storage.Copy(ctx, from, to, storage.CopyOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Verified)
+	require.NoError(t, fromCloser.Close())
+	require.NoError(t, toCloser.Close())
+
+	back, backCloser, err := storage.Open(ctx, "file:"+filepath.Join(dir, "copy.txt"), storage.OpenOptions{})
+	require.NoError(t, err)
+	to, toCloser, err = storage.Open(ctx, "embedded:"+filepath.Join(dir, "metrics.db"), storage.OpenOptions{})
+	require.NoError(t, err)
+	defer toCloser.Close()
+	_, err = storage.Copy(ctx, to, back, storage.CopyOptions{})
+	require.NoError(t, err)
+	require.NoError(t, backCloser.Close())
+
+	restored, err := restore(t, filepath.Join(dir, "copy.txt"), storage.SnapshotOptions{}, nil)
+	require.NoError(t, err)
+	gauges, err := restored.GetGaugesValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"g": 3}, gauges)
+
+	_, _, err = storage.Open(ctx, "memory", storage.OpenOptions{})
+	assert.Error(t, err)
+}
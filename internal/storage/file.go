@@ -2,42 +2,87 @@ package storage
 
 import (
 	"context"
-	"encoding/json"
-	"os"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/logger"
 	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/telemetry"
+	"github.com/vladkonst/metrics-alerting/internal/wal"
 )
 
+// WALOptions enables the write-ahead log. Every stored metric is appended to
+// the log before the request is answered, and the log is truncated each time
+// a snapshot is written.
+type WALOptions struct {
+	Path         string
+	Sync         wal.SyncPolicy
+	SyncInterval time.Duration
+	// CheckpointInterval is used instead of the store interval when the
+	// latter is 0. With 0 the snapshot is only written on shutdown.
+	CheckpointInterval time.Duration
+}
+
 type FileManager struct {
-	filePath      string
-	storeInterval int
-	metricsCh     *chan models.Metrics
-	Metrics       map[string]models.Metrics `json:"metrics"`
+	mu                 sync.Mutex
+	filePath           string
+	storeInterval      int
+	wal                *wal.Log
+	checkpointInterval time.Duration
+	snapshot           SnapshotOptions
+	closed             bool
+	err                error
+	Metrics            map[string]models.Metrics `json:"metrics"`
 }
 
-func NewFileManager(f string, r bool, s int, c *chan models.Metrics, storage handlers.MetricRepository) (*FileManager, error) {
+func NewFileManager(f string, r bool, s int, storage handlers.MetricRepository, snapOpts SnapshotOptions, walOpts *WALOptions) (*FileManager, error) {
 	metrics := make(map[string]models.Metrics)
-	fm := FileManager{f, s, c, metrics}
+	if snapOpts.Encoding == "" {
+		snapOpts.Encoding = EncodingJSON
+	}
+	fm := FileManager{filePath: f, storeInterval: s, snapshot: snapOpts, Metrics: metrics}
+	var records []models.Metrics
+	if walOpts != nil {
+		var err error
+		fm.wal, records, err = wal.Open(walOpts.Path, walOpts.Sync, walOpts.SyncInterval)
+		if err != nil {
+			return nil, err
+		}
+
+		fm.checkpointInterval = walOpts.CheckpointInterval
+		if !r && len(records) > 0 {
+			if err := fm.wal.Truncate(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	if r {
-		if err := fm.InitMetrics(storage); err != nil {
+		if err := fm.InitMetrics(storage, records); err != nil {
 			return nil, err
 		}
 	}
 	return &fm, nil
 }
 
-func (fm *FileManager) InitMetrics(storage handlers.MetricRepository) error {
-	file, err := os.OpenFile(fm.filePath, os.O_RDONLY|os.O_CREATE, 0666)
+// InitMetrics loads the newest valid snapshot, replays the WAL records
+// written after it and puts the result into the storage.
+func (fm *FileManager) InitMetrics(storage handlers.MetricRepository, records []models.Metrics) error {
+	metrics, err := readSnapshot(fm.filePath, fm.snapshot.Keep)
 	if err != nil {
 		return err
 	}
 
-	defer file.Close()
-	dec := json.NewDecoder(file)
-	if err = dec.Decode(&fm.Metrics); err != nil && err.Error() != "EOF" {
-		return err
+	fm.Metrics = metrics
+	for _, metric := range records {
+		fm.Metrics[seriesKey(&metric)] = metric
+	}
+
+	if len(records) > 0 {
+		log := logger.Get()
+		log.Info().Int("records", len(records)).Msg("replayed WAL")
 	}
 
 	for _, metric := range fm.Metrics {
@@ -50,46 +95,139 @@ func (fm *FileManager) InitMetrics(storage handlers.MetricRepository) error {
 	return nil
 }
 
+var (
+	snapshotDuration = telemetry.Default.Histogram("snapshot_duration_seconds",
+		"Time to encode and write a snapshot file.", telemetry.DurationBuckets)
+	snapshotSize   = telemetry.Default.Gauge("snapshot_size_bytes", "Size of the last snapshot file written.")
+	snapshotErrors = telemetry.Default.Counter("snapshot_errors_total", "Failed snapshot writes.")
+)
+
 func (fm *FileManager) LoadMetrics() error {
-	file, err := os.OpenFile(fm.filePath, os.O_WRONLY|os.O_TRUNC, 0666)
+	start := time.Now()
+	data, err := encodeSnapshot(fm.Metrics, fm.snapshot.Encoding)
+	if err == nil {
+		err = writeSnapshot(fm.filePath, data, fm.snapshot.Keep)
+	}
+
+	snapshotDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		snapshotErrors.Inc()
 		return err
 	}
 
-	defer file.Close()
-	enc := json.NewEncoder(file)
-	if err := enc.Encode(fm.Metrics); err != nil {
+	snapshotSize.Set(float64(len(data)))
+	return nil
+}
+
+// Checkpoint writes a snapshot and drops the WAL records it covers.
+func (fm *FileManager) Checkpoint() error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	return fm.checkpoint()
+}
+
+func (fm *FileManager) checkpoint() error {
+	if fm.closed {
+		return nil
+	}
+
+	fm.err = fm.LoadMetrics()
+	if fm.err == nil && fm.wal != nil {
+		fm.err = fm.wal.Truncate()
+	}
+
+	return fm.err
+}
+
+// Err returns the error of the last snapshot or WAL write, nil once one
+// succeeds again.
+func (fm *FileManager) Err() error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	return fm.err
+}
+
+// Append records stored metrics. It appends them to the WAL or, with a store
+// interval of 0 and no WAL, writes a snapshot before returning.
+func (fm *FileManager) Append(ctx context.Context, metrics ...models.Metrics) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if fm.closed {
+		return nil
+	}
+
+	for _, metric := range metrics {
+		fm.Metrics[seriesKey(&metric)] = metric
+	}
+
+	switch {
+	case fm.wal != nil:
+		fm.err = fm.wal.Append(metrics...)
+	case fm.storeInterval == 0:
+		fm.err = fm.LoadMetrics()
+	default:
+		return nil
+	}
+
+	return fm.err
+}
+
+// Replace makes the metrics the only series and checkpoints, so the series
+// removed from the storage are not restored from the snapshot or the WAL.
+// The previous series are kept when the checkpoint fails.
+func (fm *FileManager) Replace(ctx context.Context, metrics []models.Metrics) error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	old := fm.Metrics
+	fm.Metrics = make(map[string]models.Metrics, len(metrics))
+	for _, metric := range metrics {
+		fm.Metrics[seriesKey(&metric)] = metric
+	}
+
+	if err := fm.checkpoint(); err != nil {
+		fm.Metrics = old
 		return err
 	}
 	return nil
 }
 
-func (fm *FileManager) ProcessMetricsSync() error {
-	for metric := range *fm.metricsCh {
-		fm.Metrics[metric.ID] = metric
-		if err := fm.LoadMetrics(); err != nil {
-			return err
-		}
+// Close writes the final snapshot and closes the WAL. Metrics appended
+// afterwards are ignored.
+func (fm *FileManager) Close() error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	err := fm.checkpoint()
+	fm.closed = true
+	if fm.wal != nil {
+		err = errors.Join(err, fm.wal.Close())
 	}
 
-	return nil
+	return err
 }
 
-func (fm *FileManager) ProcessMetrics() error {
+// ProcessMetrics checkpoints every store interval, or every checkpoint
+// interval with a WAL and a store interval of 0, until ctx is done. The
+// final snapshot is written by Close.
+func (fm *FileManager) ProcessMetrics(ctx context.Context) error {
+	interval := time.Second * time.Duration(fm.storeInterval)
 	if fm.storeInterval == 0 {
-		go fm.ProcessMetricsSync()
+		interval = fm.checkpointInterval
+	}
+
+	if interval <= 0 {
 		return nil
 	}
 
-	tc := time.NewTicker(time.Second * time.Duration(fm.storeInterval))
+	tc := time.NewTicker(interval)
+	defer tc.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return nil
 		case <-tc.C:
-			if err := fm.LoadMetrics(); err != nil {
+			if err := fm.Checkpoint(); err != nil {
 				return err
 			}
-		case metric := <-*fm.metricsCh:
-			fm.Metrics[metric.ID] = metric
 		}
 	}
 }
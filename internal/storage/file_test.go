@@ -0,0 +1,188 @@
+package storage_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/storage"
+	"github.com/vladkonst/metrics-alerting/internal/wal"
+)
+
+func restore(t *testing.T, path string, opts storage.SnapshotOptions, walOpts *storage.WALOptions) (*storage.MemStorage, error) {
+	ch := make(chan models.Metrics)
+	ms := storage.NewMemStorage(&ch)
+	fm, err := storage.NewFileManager(path, true, 1, ms, opts, walOpts)
+	if err == nil && walOpts != nil {
+		require.NoError(t, fm.Close())
+	}
+	return ms, err
+}
+
+func snapshot(t *testing.T, path string, opts storage.SnapshotOptions, gauges map[string]float64) {
+	ch := make(chan models.Metrics)
+	fm, err := storage.NewFileManager(path, false, 1, storage.NewMemStorage(&ch), opts, nil)
+	require.NoError(t, err)
+	for id, v := range gauges {
+		fm.Metrics["gauge:"+id] = models.Metrics{ID: id, MType: "gauge", Value: &v}
+	}
+	require.NoError(t, fm.LoadMetrics())
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    storage.SnapshotOptions
+		corrupt func(t *testing.T, path string)
+		want    map[string]float64
+		wantErr bool
+	}{
+		{name: "json test", opts: storage.SnapshotOptions{Encoding: storage.EncodingJSON, Keep: 2}, want: map[string]float64{"m": 2}},
+		{name: "gzip test", opts: storage.SnapshotOptions{Encoding: storage.EncodingGzip, Keep: 2}, want: map[string]float64{"m": 2}},
+		{
+			name: "fallback to previous snapshot test",
+			opts: storage.SnapshotOptions{Encoding: storage.EncodingJSON, Keep: 2},
+			corrupt: func(t *testing.T, path string) {
+				b, err := os.ReadFile(path)
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(path, b[:len(b)-5], 0666))
+			},
+			want: map[string]float64{"m": 1},
+		},
+		{
+			name: "missing latest snapshot test",
+			opts: storage.SnapshotOptions{Encoding: storage.EncodingJSON, Keep: 2},
+			corrupt: func(t *testing.T, path string) {
+				require.NoError(t, os.Remove(path))
+			},
+			want: map[string]float64{"m": 1},
+		},
+		{
+			name: "no valid snapshot test",
+			opts: storage.SnapshotOptions{Encoding: storage.EncodingGzip},
+			corrupt: func(t *testing.T, path string) {
+				require.NoError(t, os.WriteFile(path, []byte("garbage"), 0666))
+			},
+			wantErr: true,
+		},
+		{
+			name: "legacy format test",
+			opts: storage.SnapshotOptions{Encoding: storage.EncodingJSON},
+			corrupt: func(t *testing.T, path string) {
+				require.NoError(t, os.WriteFile(path, []byte(`{"m":{"id":"m","type":"gauge","value":5}}`+"\n"), 0666))
+			},
+			want: map[string]float64{"m": 5},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "metrics.txt")
+			snapshot(t, path, test.opts, map[string]float64{"m": 1})
+			snapshot(t, path, test.opts, map[string]float64{"m": 2})
+			if test.corrupt != nil {
+				test.corrupt(t, path)
+			}
+
+			ms, err := restore(t, path, test.opts, nil)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			gauges, err := ms.GetGaugesValues(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, test.want, gauges)
+		})
+	}
+}
+
+func TestSnapshotRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.txt")
+	opts := storage.SnapshotOptions{Keep: 2}
+	for i := 0; i < 5; i++ {
+		snapshot(t, path, opts, map[string]float64{"m": float64(i)})
+	}
+
+	matches, err := filepath.Glob(path + "*")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{path, path + ".1", path + ".2"}, matches)
+
+	for i, file := range []string{path, path + ".1", path + ".2"} {
+		ms, err := restore(t, file, storage.SnapshotOptions{}, nil)
+		require.NoError(t, err)
+		gauges, err := ms.GetGaugesValues(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, map[string]float64{"m": float64(4 - i)}, gauges, file)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.txt")
+	opts := storage.SnapshotOptions{Keep: 1}
+	snapshot(t, path, opts, map[string]float64{"m": 1, "n": 1})
+
+	walOpts := &storage.WALOptions{Path: filepath.Join(dir, "metrics.wal"), Sync: wal.SyncAlways}
+	l, _, err := wal.Open(walOpts.Path, walOpts.Sync, 0)
+	require.NoError(t, err)
+	v, d := 2.0, int64(7)
+	require.NoError(t, l.Append(models.Metrics{ID: "m", MType: "gauge", Value: &v}))
+	require.NoError(t, l.Append(models.Metrics{ID: "m", MType: "counter", Delta: &d}))
+	require.NoError(t, l.Close())
+
+	ms, err := restore(t, path, opts, walOpts)
+	require.NoError(t, err)
+	gauges, err := ms.GetGaugesValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"m": 2, "n": 1}, gauges)
+	counters, err := ms.GetCountersValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"m": 7}, counters)
+
+	_, records, err := wal.Open(walOpts.Path, walOpts.Sync, 0)
+	require.NoError(t, err)
+	assert.Empty(t, records, "closing the file manager checkpoints the WAL")
+}
+
+func TestFileManagerReplace(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.txt")
+	opts := storage.SnapshotOptions{Keep: 1}
+	snapshot(t, path, opts, map[string]float64{"m": 1})
+
+	walOpts := &storage.WALOptions{Path: filepath.Join(dir, "metrics.wal"), Sync: wal.SyncAlways}
+	ch := make(chan models.Metrics)
+	fm, err := storage.NewFileManager(path, true, 0, storage.NewMemStorage(&ch), opts, walOpts)
+	require.NoError(t, err)
+	v := 2.0
+	require.NoError(t, fm.Replace(context.Background(), []models.Metrics{{ID: "n", MType: "gauge", Value: &v}}))
+	require.NoError(t, fm.Close())
+
+	ms, err := restore(t, path, opts, walOpts)
+	require.NoError(t, err)
+	gauges, err := ms.GetGaugesValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"n": 2}, gauges)
+}
+
+func TestFileManagerAppend(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.txt")
+	ch := make(chan models.Metrics)
+	fm, err := storage.NewFileManager(path, false, 0, storage.NewMemStorage(&ch), storage.SnapshotOptions{}, nil)
+	require.NoError(t, err)
+	v := 1.5
+	require.NoError(t, fm.Append(context.Background(), models.Metrics{ID: "m", MType: "gauge", Value: &v}))
+
+	ms, err := restore(t, path, storage.SnapshotOptions{}, nil)
+	require.NoError(t, err)
+	gauges, err := ms.GetGaugesValues(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"m": 1.5}, gauges, "a store interval of 0 writes the snapshot on append")
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/telemetry"
+)
+
+var (
+	operationDuration = telemetry.Default.Histogram("storage_operation_duration_seconds",
+		"Storage operation latencies by operation.", telemetry.DurationBuckets, "operation")
+	operationErrors = telemetry.Default.Counter("storage_operation_errors_total",
+		"Failed storage operations by operation.", "operation")
+)
+
+// InstrumentedStorage measures the operations of the storage it wraps.
+// SwapMetrics, ReplaceMetrics, Snapshot and Reset return
+// errors.ErrUnsupported when the wrapped storage lacks them.
+type InstrumentedStorage struct {
+	storage handlers.MetricRepository
+}
+
+func NewInstrumentedStorage(s handlers.MetricRepository) *InstrumentedStorage {
+	return &InstrumentedStorage{storage: s}
+}
+
+func observe(op string, start time.Time, err error) {
+	operationDuration.Observe(time.Since(start).Seconds(), op)
+	if err != nil {
+		operationErrors.Inc(op)
+	}
+}
+
+func (s *InstrumentedStorage) AddMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
+	start := time.Now()
+	stored, err := s.storage.AddMetrics(ctx, metrics)
+	observe("add_metrics", start, err)
+	return stored, err
+}
+
+func (s *InstrumentedStorage) AddMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	start := time.Now()
+	stored, err := s.storage.AddMetric(ctx, metric)
+	observe("add_metric", start, err)
+	return stored, err
+}
+
+// GetMetric doesn't count unknown metrics as errors, they are looked up on
+// every first write when auditing.
+func (s *InstrumentedStorage) GetMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	start := time.Now()
+	found, err := s.storage.GetMetric(ctx, metric)
+	if errors.Is(err, models.ErrNotFound) {
+		observe("get_metric", start, nil)
+	} else {
+		observe("get_metric", start, err)
+	}
+	return found, err
+}
+
+func (s *InstrumentedStorage) GetGaugesValues(ctx context.Context) (map[string]float64, error) {
+	start := time.Now()
+	gauges, err := s.storage.GetGaugesValues(ctx)
+	observe("get_gauges", start, err)
+	return gauges, err
+}
+
+func (s *InstrumentedStorage) GetCountersValues(ctx context.Context) (map[string]int64, error) {
+	start := time.Now()
+	counters, err := s.storage.GetCountersValues(ctx)
+	observe("get_counters", start, err)
+	return counters, err
+}
+
+func (s *InstrumentedStorage) SwapMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, map[string]*models.Metrics, error) {
+	sw, ok := s.storage.(handlers.Swapper)
+	if !ok {
+		return nil, nil, errors.ErrUnsupported
+	}
+
+	start := time.Now()
+	stored, previous, err := sw.SwapMetrics(ctx, metrics)
+	observe("add_metrics", start, err)
+	return stored, previous, err
+}
+
+func (s *InstrumentedStorage) Snapshot(ctx context.Context) ([]models.Metrics, error) {
+	ss, ok := s.storage.(handlers.Snapshotter)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	start := time.Now()
+	metrics, err := ss.Snapshot(ctx)
+	observe("snapshot", start, err)
+	return metrics, err
+}
+
+func (s *InstrumentedStorage) Reset(ctx context.Context) error {
+	r, ok := s.storage.(handlers.Resetter)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+
+	start := time.Now()
+	err := r.Reset(ctx)
+	observe("reset", start, err)
+	return err
+}
+
+func (s *InstrumentedStorage) ReplaceMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
+	r, ok := s.storage.(handlers.Replacer)
+	if !ok {
+		return nil, errors.ErrUnsupported
+	}
+
+	start := time.Now()
+	stored, err := r.ReplaceMetrics(ctx, metrics)
+	observe("replace_metrics", start, err)
+	return stored, err
+}
+
+func (s *InstrumentedStorage) Ping(ctx context.Context) error {
+	if p, ok := s.storage.(handlers.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/storage"
+	"github.com/vladkonst/metrics-alerting/internal/storage/storagetest"
+	"github.com/vladkonst/metrics-alerting/internal/telemetry"
+)
+
+func TestInstrumentedStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) handlers.MetricRepository {
+		return storage.NewInstrumentedStorage(newMemStorage())
+	}, storagetest.Options{})
+}
+
+// plainStorage hides the optional interfaces of the storage it embeds.
+type plainStorage struct {
+	handlers.MetricRepository
+}
+
+func TestInstrumentedStorageUnsupported(t *testing.T) {
+	s := storage.NewInstrumentedStorage(plainStorage{newMemStorage()})
+	ctx := context.Background()
+	_, err := s.Snapshot(ctx)
+	assert.True(t, errors.Is(err, errors.ErrUnsupported))
+	assert.True(t, errors.Is(s.Reset(ctx), errors.ErrUnsupported))
+	assert.NoError(t, s.Ping(ctx))
+}
+
+func TestInstrumentedStorageErrors(t *testing.T) {
+	count := func(name, op string) float64 {
+		for _, sample := range telemetry.Default.Samples() {
+			if sample.Name == name && sample.Labels["operation"] == op {
+				return sample.Value
+			}
+		}
+		return 0
+	}
+
+	s := storage.NewInstrumentedStorage(newMemStorage())
+	calls, errs := count("server_storage_operation_duration_seconds_count", "add_metric"), count("server_storage_operation_errors_total", "add_metric")
+	_, err := s.AddMetric(context.Background(), &models.Metrics{ID: "x", MType: "histogram"})
+	require.Error(t, err)
+	d := int64(1)
+	_, err = s.AddMetric(context.Background(), &models.Metrics{ID: "x", MType: "counter", Delta: &d})
+	require.NoError(t, err)
+
+	assert.Equal(t, calls+2, count("server_storage_operation_duration_seconds_count", "add_metric"))
+	assert.Equal(t, errs+1, count("server_storage_operation_errors_total", "add_metric"))
+
+	calls, errs = count("server_storage_operation_duration_seconds_count", "get_metric"), count("server_storage_operation_errors_total", "get_metric")
+	_, err = s.GetMetric(context.Background(), &models.Metrics{ID: "missing", MType: "counter"})
+	require.ErrorIs(t, err, models.ErrNotFound)
+	_, err = s.GetMetric(context.Background(), &models.Metrics{ID: "x", MType: "histogram"})
+	require.Error(t, err)
+
+	assert.Equal(t, calls+2, count("server_storage_operation_duration_seconds_count", "get_metric"))
+	assert.Equal(t, errs+1, count("server_storage_operation_errors_total", "get_metric"))
+}
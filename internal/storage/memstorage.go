@@ -3,95 +3,328 @@ package storage
 import (
 	"context"
 	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
 
 	"github.com/vladkonst/metrics-alerting/internal/models"
 )
 
+const shardCount = 32
+
+// shard owns the series whose names hash to it. Its mutex guards the maps,
+// the values themselves are updated atomically.
+type shard struct {
+	mu       sync.RWMutex
+	gauges   map[string]*atomic.Uint64
+	counters map[string]*atomic.Int64
+}
+
+// MemStorage is safe for concurrent use. Writers share the snapshot lock
+// and the readers of all values take it exclusively, so they never see half
+// of a batch.
 type MemStorage struct {
-	gauges    map[string]*models.Metrics
-	counters  map[string]*models.Metrics
+	snapshot  sync.RWMutex
+	shards    [shardCount]shard
 	metricsCh *chan models.Metrics
 }
 
 func NewMemStorage(metricsCh *chan models.Metrics) *MemStorage {
-	storage := MemStorage{gauges: make(map[string]*models.Metrics), counters: make(map[string]*models.Metrics), metricsCh: metricsCh}
+	storage := MemStorage{metricsCh: metricsCh}
+	for i := range storage.shards {
+		storage.shards[i].gauges = make(map[string]*atomic.Uint64)
+		storage.shards[i].counters = make(map[string]*atomic.Int64)
+	}
 	return &storage
 }
 
+// shardFor hashes the name with FNV-1a.
+func (m *MemStorage) shardFor(name string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return &m.shards[h%shardCount]
+}
+
 func (m *MemStorage) GetCountersValues(ctx context.Context) (map[string]int64, error) {
-	countersValues := make(map[string]int64, len(m.counters))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	for k, v := range m.counters {
-		countersValues[k] = *v.Delta
+	m.snapshot.Lock()
+	defer m.snapshot.Unlock()
+	countersValues := make(map[string]int64)
+	for i := range m.shards {
+		for k, v := range m.shards[i].counters {
+			countersValues[k] = v.Load()
+		}
 	}
 
 	return countersValues, nil
 }
 
 func (m *MemStorage) GetGaugesValues(ctx context.Context) (map[string]float64, error) {
-	gaugesValues := make(map[string]float64, len(m.gauges))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	for k, v := range m.gauges {
-		gaugesValues[k] = *v.Value
+	m.snapshot.Lock()
+	defer m.snapshot.Unlock()
+	gaugesValues := make(map[string]float64)
+	for i := range m.shards {
+		for k, v := range m.shards[i].gauges {
+			gaugesValues[k] = math.Float64frombits(v.Load())
+		}
 	}
 
 	return gaugesValues, nil
 }
 
 func (m *MemStorage) AddMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
-	for i, metric := range metrics {
-		switch metric.MType {
-		case "counter":
-			if _, ok := m.counters[metric.ID]; !ok {
-				m.counters[metric.ID] = &metric
-			} else {
-				*(m.counters[metric.ID].Delta) += *metric.Delta
-				metrics[i] = *m.counters[metric.ID]
-			}
-			metrics[i] = *m.counters[metric.ID]
-		case "gauge":
-			m.gauges[metric.ID] = &metric
-			metrics[i] = *m.gauges[metric.ID]
-		default:
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, metric := range metrics {
+		if metric.MType != "counter" && metric.MType != "gauge" {
 			return nil, errors.New("provided metric type is incorrect")
 		}
 	}
 
-	return metrics, nil
+	m.snapshot.RLock()
+	defer m.snapshot.RUnlock()
+	stored := make([]models.Metrics, 0, len(metrics))
+	for _, metric := range metrics {
+		stored = append(stored, *m.add(&metric))
+	}
+
+	return stored, nil
 }
 
-func (m *MemStorage) AddMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
-	switch metric.MType {
-	case "counter":
-		if _, ok := m.counters[metric.ID]; !ok {
-			m.counters[metric.ID] = metric
-		} else {
-			*(m.counters[metric.ID].Delta) += *metric.Delta
+// SwapMetrics stores the batch like AddMetrics and returns the values the
+// series had before it.
+func (m *MemStorage) SwapMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, map[string]*models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	for _, metric := range metrics {
+		if metric.MType != "counter" && metric.MType != "gauge" {
+			return nil, nil, errors.New("provided metric type is incorrect")
 		}
-		return m.counters[metric.ID], nil
-	case "gauge":
-		m.gauges[metric.ID] = metric
-		return m.gauges[metric.ID], nil
-	default:
+	}
+
+	m.snapshot.RLock()
+	defer m.snapshot.RUnlock()
+	stored := make([]models.Metrics, 0, len(metrics))
+	previous := make(map[string]*models.Metrics, len(metrics))
+	for _, metric := range metrics {
+		s, prev := m.swap(&metric)
+		k := seriesKey(&metric)
+		if _, ok := previous[k]; !ok {
+			previous[k] = prev
+		}
+		stored = append(stored, *s)
+	}
+
+	return stored, previous, nil
+}
+
+// ReplaceMetrics removes every series and stores the batch. Readers see
+// either the old series or the new ones.
+func (m *MemStorage) ReplaceMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, metric := range metrics {
+		if metric.MType != "counter" && metric.MType != "gauge" {
+			return nil, errors.New("provided metric type is incorrect")
+		}
+	}
+
+	m.snapshot.Lock()
+	defer m.snapshot.Unlock()
+	m.reset()
+	stored := make([]models.Metrics, 0, len(metrics))
+	for _, metric := range metrics {
+		stored = append(stored, *m.add(&metric))
+	}
+
+	return stored, nil
+}
+
+func (m *MemStorage) AddMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if metric.MType != "counter" && metric.MType != "gauge" {
 		return nil, errors.New("provided metric type is incorrect")
 	}
+
+	m.snapshot.RLock()
+	defer m.snapshot.RUnlock()
+	return m.add(metric), nil
+}
+
+// add stores a metric of a known type and returns a copy of the result.
+func (m *MemStorage) add(metric *models.Metrics) *models.Metrics {
+	stored, _ := m.swap(metric)
+	return stored
+}
+
+// swap stores a metric of a known type and returns a copy of the result
+// and of the value it replaced, nil when the series is new.
+func (m *MemStorage) swap(metric *models.Metrics) (*models.Metrics, *models.Metrics) {
+	s := m.shardFor(metric.ID)
+	stored := &models.Metrics{ID: metric.ID, MType: metric.MType}
+	prev := &models.Metrics{ID: metric.ID, MType: metric.MType}
+	if metric.MType == "counter" {
+		c, created := s.counter(metric.ID)
+		d := c.Add(*metric.Delta)
+		p := d - *metric.Delta
+		stored.Delta, prev.Delta = &d, &p
+		if created && p == 0 {
+			prev = nil
+		}
+		return stored, prev
+	}
+
+	v := *metric.Value
+	g, created := s.gauge(metric.ID)
+	p := math.Float64frombits(g.Swap(math.Float64bits(v)))
+	stored.Value, prev.Value = &v, &p
+	if created {
+		prev = nil
+	}
+	return stored, prev
+}
+
+// set overwrites the value of a metric of a known type, counters included.
+func (m *MemStorage) set(metric *models.Metrics) {
+	m.snapshot.RLock()
+	defer m.snapshot.RUnlock()
+	s := m.shardFor(metric.ID)
+	if metric.MType == "counter" {
+		c, _ := s.counter(metric.ID)
+		c.Store(*metric.Delta)
+		return
+	}
+
+	g, _ := s.gauge(metric.ID)
+	g.Store(math.Float64bits(*metric.Value))
+}
+
+// counter returns the counter of the name, creating it when created is
+// true.
+func (s *shard) counter(name string) (c *atomic.Int64, created bool) {
+	s.mu.RLock()
+	c, ok := s.counters[name]
+	s.mu.RUnlock()
+	if ok {
+		return c, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok = s.counters[name]; !ok {
+		c = new(atomic.Int64)
+		s.counters[name] = c
+	}
+	return c, !ok
+}
+
+func (s *shard) gauge(name string) (g *atomic.Uint64, created bool) {
+	s.mu.RLock()
+	g, ok := s.gauges[name]
+	s.mu.RUnlock()
+	if ok {
+		return g, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if g, ok = s.gauges[name]; !ok {
+		g = new(atomic.Uint64)
+		s.gauges[name] = g
+	}
+	return g, !ok
 }
 
 func (m *MemStorage) GetMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s := m.shardFor(metric.ID)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	switch metric.MType {
 	case "counter":
-		if counter, ok := m.counters[metric.ID]; !ok {
-			return nil, errors.New("can't find metric by provided name")
-		} else {
-			return counter, nil
+		counter, ok := s.counters[metric.ID]
+		if !ok {
+			return nil, models.ErrNotFound
 		}
+		d := counter.Load()
+		return &models.Metrics{ID: metric.ID, MType: metric.MType, Delta: &d}, nil
 	case "gauge":
-		if gauge, ok := m.gauges[metric.ID]; !ok {
-			return nil, errors.New("can't find metric by provided name")
-		} else {
-			return gauge, nil
+		gauge, ok := s.gauges[metric.ID]
+		if !ok {
+			return nil, models.ErrNotFound
 		}
+		v := math.Float64frombits(gauge.Load())
+		return &models.Metrics{ID: metric.ID, MType: metric.MType, Value: &v}, nil
 	default:
 		return nil, errors.New("provided metric type is incorrect")
 	}
 }
+
+// Snapshot returns every series at a single point in time.
+func (m *MemStorage) Snapshot(ctx context.Context) ([]models.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.snapshot.Lock()
+	defer m.snapshot.Unlock()
+	metrics := make([]models.Metrics, 0)
+	for i := range m.shards {
+		s := &m.shards[i]
+		for k, v := range s.gauges {
+			g := math.Float64frombits(v.Load())
+			metrics = append(metrics, models.Metrics{ID: k, MType: "gauge", Value: &g})
+		}
+		for k, v := range s.counters {
+			d := v.Load()
+			metrics = append(metrics, models.Metrics{ID: k, MType: "counter", Delta: &d})
+		}
+	}
+
+	return metrics, nil
+}
+
+// Reset removes every series.
+func (m *MemStorage) Reset(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.snapshot.Lock()
+	defer m.snapshot.Unlock()
+	m.reset()
+	return nil
+}
+
+// reset is called with the snapshot lock held.
+func (m *MemStorage) reset() {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.mu.Lock()
+		s.gauges = make(map[string]*atomic.Uint64)
+		s.counters = make(map[string]*atomic.Int64)
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,112 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/storage"
+	"github.com/vladkonst/metrics-alerting/internal/storage/storagetest"
+)
+
+func newMemStorage() *storage.MemStorage {
+	ch := make(chan models.Metrics)
+	return storage.NewMemStorage(&ch)
+}
+
+func TestMemStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) handlers.MetricRepository {
+		return newMemStorage()
+	}, storagetest.Options{})
+}
+
+func TestMemStorageConsistentSnapshot(t *testing.T) {
+	s := newMemStorage()
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				batch := []models.Metrics{storagetest.Gauge("a", float64(i)), storagetest.Counter("a", 1), storagetest.Gauge("b", float64(i)), storagetest.Counter("b", 1)}
+				if _, err := s.AddMetrics(ctx, batch); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		counters, err := s.GetCountersValues(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, counters["a"], counters["b"], "a batch is never seen half applied")
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func BenchmarkMemStorageParallel(b *testing.B) {
+	for _, series := range []int{1, 100, 10000} {
+		names := make([]string, series)
+		for i := range names {
+			names[i] = fmt.Sprintf("metric%d", i)
+		}
+
+		b.Run(fmt.Sprintf("update/%d", series), func(b *testing.B) {
+			s := newMemStorage()
+			ctx := context.Background()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					m := storagetest.Counter(names[i%series], 1)
+					if i%2 == 0 {
+						m = storagetest.Gauge(names[i%series], float64(i))
+					}
+					if _, err := s.AddMetric(ctx, &m); err != nil {
+						b.Fatal(err)
+					}
+					i++
+				}
+			})
+		})
+
+		b.Run(fmt.Sprintf("mixed/%d", series), func(b *testing.B) {
+			s := newMemStorage()
+			ctx := context.Background()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					var err error
+					switch i % 10 {
+					case 0:
+						_, err = s.GetGaugesValues(ctx)
+					case 1, 2, 3, 4:
+						// The series may not be written yet.
+						s.GetMetric(ctx, &models.Metrics{ID: names[i%series], MType: "counter"})
+					default:
+						m := storagetest.Counter(names[i%series], 1)
+						_, err = s.AddMetric(ctx, &m)
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/vladkonst/metrics-alerting/internal/logger"
+)
+
+const (
+	notifyChannel = "metrics_changed"
+	// maxNotifyKeysSize keeps payloads below the 8000 byte NOTIFY limit.
+	maxNotifyKeysSize = 7000
+)
+
+type notification struct {
+	Replica string   `json:"replica"`
+	Keys    []string `json:"keys"`
+}
+
+// PGNotifier exchanges changed series between replicas with LISTEN/NOTIFY.
+// Notifications sent by the same replica are ignored.
+type PGNotifier struct {
+	pool    *pgxpool.Pool
+	replica string
+}
+
+func NewPGNotifier(pool *pgxpool.Pool, replica string) *PGNotifier {
+	return &PGNotifier{pool: pool, replica: replica}
+}
+
+// Notify sends nil keys as a single notification asking for a full reload.
+func (n *PGNotifier) Notify(ctx context.Context, keys []string) error {
+	if keys == nil {
+		return n.send(ctx, nil)
+	}
+
+	for len(keys) > 0 {
+		size, i := 0, 0
+		for ; i < len(keys) && size+len(keys[i]) < maxNotifyKeysSize; i++ {
+			size += len(keys[i]) + 3
+		}
+		if i == 0 {
+			i = 1
+		}
+
+		if err := n.send(ctx, keys[:i]); err != nil {
+			return err
+		}
+		keys = keys[i:]
+	}
+
+	return nil
+}
+
+func (n *PGNotifier) send(ctx context.Context, keys []string) error {
+	payload, err := json.Marshal(notification{Replica: n.replica, Keys: keys})
+	if err != nil {
+		return err
+	}
+
+	_, err = n.pool.Exec(ctx, "SELECT pg_notify($1, $2)", notifyChannel, string(payload))
+	return err
+}
+
+// Listen reconnects after errors and asks for a full reload every time it
+// does, since notifications sent in between are lost.
+func (n *PGNotifier) Listen(ctx context.Context, fn func(keys []string)) error {
+	log := logger.Get()
+	for first := true; ; first = false {
+		if !first {
+			fn(nil)
+		}
+
+		err := n.listen(ctx, fn)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		log.Error().Err(err).Msg("lost metric invalidation listener, reconnecting")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (n *PGNotifier) listen(ctx context.Context, fn func(keys []string)) error {
+	conn, err := n.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// The connection has a LISTEN registered and must not return to the
+	// pool.
+	pgc := conn.Hijack()
+	defer pgc.Close(context.Background())
+
+	if _, err := pgc.Exec(ctx, "LISTEN "+notifyChannel); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := pgc.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var note notification
+		if err := json.Unmarshal([]byte(msg.Payload), &note); err != nil || note.Replica == n.replica || (note.Keys != nil && len(note.Keys) == 0) {
+			continue
+		}
+		fn(note.Keys)
+	}
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/migrations"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/pgretry"
+)
+
+// OpenOptions controls Open.
+type OpenOptions struct {
+	// SkipMigrations leaves the schema of a Postgres database as it is, for
+	// callers that must not write to it.
+	SkipMigrations bool
+}
+
+// Open returns the storage described by uri:
+//
+//	file:PATH                  a FileManager snapshot, written back on Close
+//	embedded:PATH              a bbolt database
+//	postgres://… or postgresql://…  a Postgres database, migrated to the latest schema
+//	                           unless opts.SkipMigrations is set
+func Open(ctx context.Context, uri string, opts OpenOptions) (handlers.MetricRepository, io.Closer, error) {
+	scheme, rest, ok := strings.Cut(uri, ":")
+	if !ok {
+		return nil, nil, fmt.Errorf("storage URI %q has no scheme", uri)
+	}
+
+	switch scheme {
+	case "file":
+		return openFile(ctx, rest)
+	case "embedded":
+		s, err := NewBoltStorage(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, s, nil
+	case "postgres", "postgresql":
+		pool, err := pgxpool.New(ctx, uri)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := pool.Ping(ctx); err != nil {
+			pool.Close()
+			return nil, nil, err
+		}
+
+		if !opts.SkipMigrations {
+			if _, err := migrations.Up(ctx, pool); err != nil {
+				pool.Close()
+				return nil, nil, err
+			}
+		}
+		return NewPGStorage(pool, pgretry.NewBreaker(0, 0)), closerFunc(func() error { pool.Close(); return nil }), nil
+	default:
+		return nil, nil, fmt.Errorf("unknown storage scheme %q", scheme)
+	}
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// snapshotFile keeps a snapshot in memory and writes it back when closed
+// if it was changed.
+type snapshotFile struct {
+	*MemStorage
+	path  string
+	dirty atomic.Bool
+}
+
+func openFile(ctx context.Context, path string) (handlers.MetricRepository, io.Closer, error) {
+	metrics, err := readSnapshot(path, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch := make(chan models.Metrics)
+	f := &snapshotFile{MemStorage: NewMemStorage(&ch), path: path}
+	for _, m := range metrics {
+		if _, err := f.MemStorage.AddMetric(ctx, &m); err != nil {
+			return nil, nil, err
+		}
+	}
+	return f, f, nil
+}
+
+func (f *snapshotFile) AddMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
+	f.dirty.Store(true)
+	return f.MemStorage.AddMetrics(ctx, metrics)
+}
+
+func (f *snapshotFile) SwapMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, map[string]*models.Metrics, error) {
+	f.dirty.Store(true)
+	return f.MemStorage.SwapMetrics(ctx, metrics)
+}
+
+func (f *snapshotFile) AddMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	f.dirty.Store(true)
+	return f.MemStorage.AddMetric(ctx, metric)
+}
+
+func (f *snapshotFile) Close() error {
+	if !f.dirty.Load() {
+		return nil
+	}
+
+	metrics, err := allMetrics(context.Background(), f.MemStorage)
+	if err != nil {
+		return err
+	}
+
+	data, err := encodeSnapshot(bySeries(metrics), EncodingJSON)
+	if err != nil {
+		return err
+	}
+	return writeSnapshot(f.path, data, 0)
+}
+
+func (f *snapshotFile) ReplaceMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
+	f.dirty.Store(true)
+	return f.MemStorage.ReplaceMetrics(ctx, metrics)
+}
+
+func (f *snapshotFile) Reset(ctx context.Context) error {
+	f.dirty.Store(true)
+	return f.MemStorage.Reset(ctx)
+}
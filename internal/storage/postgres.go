@@ -2,64 +2,51 @@ package storage
 
 import (
 	"context"
-	"database/sql"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/pgretry"
 )
 
 type PGStorage struct {
-	conn *sql.DB
+	pool    *pgxpool.Pool
+	breaker *pgretry.Breaker
 }
 
-func NewPGStorage(conn *sql.DB) *PGStorage {
-	storage := PGStorage{conn: conn}
-	storage.Bootstrap(context.Background())
-	return &storage
+// NewPGStorage expects the schema to be created by the migrations package.
+// Every query goes through the breaker.
+func NewPGStorage(pool *pgxpool.Pool, breaker *pgretry.Breaker) *PGStorage {
+	return &PGStorage{pool: pool, breaker: breaker}
 }
 
-func (s PGStorage) Bootstrap(ctx context.Context) error {
-	tx, err := s.conn.BeginTx(ctx, nil)
-	if err != nil {
-		return err
+// Ping checks the database through the breaker, so it fails fast with
+// pgretry.ErrCircuitOpen while the database is considered down.
+func (s *PGStorage) Ping(ctx context.Context) error {
+	err := s.breaker.Do(ctx, s.pool.Ping)
+	if errors.Is(err, pgretry.ErrCircuitOpen) {
+		return fmt.Errorf("database is degraded: %w", err)
 	}
 
-	defer tx.Rollback()
-	tx.ExecContext(ctx, `
-	    CREATE TABLE counters (
-	        name varchar PRIMARY KEY,
-			value bigint
-	    )
-	`)
-	tx.ExecContext(ctx, `
-	    CREATE TABLE gauges (
-	        name varchar PRIMARY KEY,
-	        value double precision
-	    )
-	`)
-	return tx.Commit()
+	return err
 }
 
 func (s *PGStorage) GetCountersValues(ctx context.Context) (map[string]int64, error) {
-	counters := make(map[string]int64)
-	rows, err := s.conn.QueryContext(ctx, "SELECT name, value FROM counters")
-	if err != nil {
-		return nil, err
-	}
-
-	defer rows.Close()
-	for rows.Next() {
-		var name string
-		var value int64
-		err = rows.Scan(&name, &value)
+	var counters map[string]int64
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		rows, err := s.pool.Query(ctx, "SELECT name, value FROM counters")
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		counters[name] = value
-	}
-
-	err = rows.Err()
+		counters = make(map[string]int64)
+		return scanValues(rows, counters)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -68,140 +55,380 @@ func (s *PGStorage) GetCountersValues(ctx context.Context) (map[string]int64, er
 }
 
 func (s *PGStorage) GetGaugesValues(ctx context.Context) (map[string]float64, error) {
-	gauges := make(map[string]float64)
-	rows, err := s.conn.QueryContext(ctx, "SELECT name, value FROM gauges")
+	var gauges map[string]float64
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		rows, err := s.pool.Query(ctx, "SELECT name, value FROM gauges")
+		if err != nil {
+			return err
+		}
+
+		gauges = make(map[string]float64)
+		return scanValues(rows, gauges)
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	return gauges, nil
+}
+
+func scanValues[V int64 | float64](rows pgx.Rows, dst map[string]V) error {
 	defer rows.Close()
 	for rows.Next() {
 		var name string
-		var value float64
-		err = rows.Scan(&name, &value)
-		if err != nil {
-			return nil, err
+		var value V
+		if err := rows.Scan(&name, &value); err != nil {
+			return err
 		}
-
-		gauges[name] = value
-	}
-
-	err = rows.Err()
-	if err != nil {
-		return nil, err
+		dst[name] = value
 	}
 
-	return gauges, nil
+	return rows.Err()
 }
 
+const (
+	upsertCounter = `INSERT INTO counters (name, value) VALUES($1,$2)
+	    ON CONFLICT (name) DO UPDATE SET value = counters.value + EXCLUDED.value
+	    RETURNING value`
+	upsertGauge = `INSERT INTO gauges (name, value) VALUES($1,$2)
+	    ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value
+	    RETURNING value`
+	upsertCounters = `INSERT INTO counters (name, value) SELECT * FROM unnest($1::varchar[], $2::bigint[])
+	    ON CONFLICT (name) DO UPDATE SET value = counters.value + EXCLUDED.value
+	    RETURNING name, value`
+	upsertGauges = `INSERT INTO gauges (name, value) SELECT * FROM unnest($1::varchar[], $2::double precision[])
+	    ON CONFLICT (name) DO UPDATE SET value = EXCLUDED.value`
+	lockCounters = `SELECT name, value FROM counters WHERE name = ANY($1::varchar[]) ORDER BY name FOR UPDATE`
+	lockGauges   = `SELECT name, value FROM gauges WHERE name = ANY($1::varchar[]) ORDER BY name FOR UPDATE`
+)
+
+// AddMetrics stores the batch with one upsert per metric type. Counters are
+// summed and gauges deduplicated before they are sent, and rows are written
+// in name order so concurrent batches lock them in the same order. Every
+// returned metric holds the value stored right after it was applied.
 func (s *PGStorage) AddMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
-	addedCounters := make(map[string]int64)
-	addedGauges := make(map[string]bool)
-	tx, err := s.conn.Begin()
-	if err != nil {
-		return nil, err
-	}
+	stored, _, err := s.addMetrics(ctx, metrics, writeAdd)
+	return stored, err
+}
+
+// SwapMetrics stores the batch like AddMetrics. The existing rows are read
+// and locked in the same transaction first, to return the values the series
+// had before the batch.
+func (s *PGStorage) SwapMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, map[string]*models.Metrics, error) {
+	return s.addMetrics(ctx, metrics, writeSwap)
+}
+
+// ReplaceMetrics truncates both tables and stores the batch like AddMetrics
+// in the same transaction.
+func (s *PGStorage) ReplaceMetrics(ctx context.Context, metrics []models.Metrics) ([]models.Metrics, error) {
+	stored, _, err := s.addMetrics(ctx, metrics, writeReplace)
+	return stored, err
+}
 
-	defer tx.Rollback()
+// writeMode selects what addMetrics does besides the upserts.
+type writeMode int
+
+const (
+	writeAdd writeMode = iota
+	// writeSwap reads the previous values.
+	writeSwap
+	// writeReplace removes all series first.
+	writeReplace
+)
 
-	for i, metric := range metrics {
+func (s *PGStorage) addMetrics(ctx context.Context, metrics []models.Metrics, mode writeMode) ([]models.Metrics, map[string]*models.Metrics, error) {
+	deltas := make(map[string]int64)
+	gauges := make(map[string]float64)
+	for _, metric := range metrics {
 		switch metric.MType {
 		case "counter":
-			var counterValue int64
-			row := s.conn.QueryRowContext(ctx, `SELECT value  FROM counters WHERE name = $1`, metric.ID)
-			err := row.Scan(&counterValue)
-			if _, ok := addedCounters[metric.ID]; err != nil && !ok {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO counters (name, value) VALUES($1,$2)", metric.ID, *metric.Delta); err != nil {
-					return nil, err
+			deltas[metric.ID] += *metric.Delta
+		case "gauge":
+			gauges[metric.ID] = *metric.Value
+		default:
+			return nil, nil, errors.New("provided metric type is incorrect")
+		}
+	}
+
+	counters := make(map[string]int64, len(deltas))
+	var oldCounters map[string]int64
+	var oldGauges map[string]float64
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+			if mode == writeReplace {
+				if _, err := tx.Exec(ctx, "TRUNCATE gauges, counters"); err != nil {
+					return err
 				}
-				addedCounters[metric.ID] += *metric.Delta
-			} else {
-				*metric.Delta = counterValue + *metric.Delta
-				if _, err := tx.ExecContext(ctx, "UPDATE counters SET value=$1 WHERE name=$2", addedCounters[metric.ID]+*metric.Delta, metric.ID); err != nil {
-					return nil, err
+			}
+
+			if mode == writeSwap {
+				oldCounters, oldGauges = make(map[string]int64), make(map[string]float64)
+				if err := lockRows(ctx, tx, lockCounters, deltas, oldCounters); err != nil {
+					return err
+				}
+				if err := lockRows(ctx, tx, lockGauges, gauges, oldGauges); err != nil {
+					return err
 				}
 			}
-			metrics[i] = metric
-		case "gauge":
-			var gaugeName string
-			row := s.conn.QueryRowContext(ctx, `SELECT name  FROM gauges WHERE name = $1`, metric.ID)
-			err := row.Scan(&gaugeName)
-			if _, ok := addedGauges[metric.ID]; err != nil && !ok {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO gauges (name, value) VALUES($1,$2)", metric.ID, *metric.Value); err != nil {
-					return nil, err
+
+			if len(deltas) > 0 {
+				names, values := sortedColumns(deltas)
+				rows, err := tx.Query(ctx, upsertCounters, names, values)
+				if err != nil {
+					return err
 				}
-				addedGauges[metric.ID] = true
-			} else {
-				if _, err := tx.ExecContext(ctx, "UPDATE gauges SET value=$1 WHERE name=$2", *metric.Value, metric.ID); err != nil {
-					return nil, err
+				if err := scanValues(rows, counters); err != nil {
+					return err
 				}
 			}
 
-		default:
-			return nil, errors.New("provided metric type is incorrect")
+			if len(gauges) > 0 {
+				names, values := sortedColumns(gauges)
+				if _, err := tx.Exec(ctx, upsertGauges, names, values); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Counters are replayed from the value they had before the batch.
+	running := make(map[string]int64, len(counters))
+	for name, v := range counters {
+		running[name] = v - deltas[name]
+	}
+
+	stored := make([]models.Metrics, 0, len(metrics))
+	for _, metric := range metrics {
+		switch metric.MType {
+		case "counter":
+			running[metric.ID] += *metric.Delta
+			v := running[metric.ID]
+			stored = append(stored, models.Metrics{ID: metric.ID, MType: metric.MType, Delta: &v})
+		case "gauge":
+			v := *metric.Value
+			stored = append(stored, models.Metrics{ID: metric.ID, MType: metric.MType, Value: &v})
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		return nil, err
+	if mode != writeSwap {
+		return stored, nil, nil
 	}
 
-	return metrics, nil
+	previous := make(map[string]*models.Metrics, len(deltas)+len(gauges))
+	for name := range deltas {
+		m := &models.Metrics{ID: name, MType: "counter"}
+		if d, ok := oldCounters[name]; ok {
+			m.Delta = &d
+			previous[seriesKey(m)] = m
+		} else {
+			previous[seriesKey(m)] = nil
+		}
+	}
+	for name := range gauges {
+		m := &models.Metrics{ID: name, MType: "gauge"}
+		if v, ok := oldGauges[name]; ok {
+			m.Value = &v
+			previous[seriesKey(m)] = m
+		} else {
+			previous[seriesKey(m)] = nil
+		}
+	}
+
+	return stored, previous, nil
+}
+
+// lockRows reads and locks the existing rows of the names.
+func lockRows[V int64 | float64](ctx context.Context, tx pgx.Tx, query string, names map[string]V, dst map[string]V) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	list, _ := sortedColumns(names)
+	rows, err := tx.Query(ctx, query, list)
+	if err != nil {
+		return err
+	}
+	return scanValues(rows, dst)
+}
+
+func sortedColumns[V int64 | float64](m map[string]V) ([]string, []V) {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	values := make([]V, 0, len(names))
+	for _, name := range names {
+		values = append(values, m[name])
+	}
+
+	return names, values
 }
 
 func (s *PGStorage) AddMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	stored := &models.Metrics{ID: metric.ID, MType: metric.MType}
+	var err error
 	switch metric.MType {
 	case "counter":
-		var counterValue int64
-		row := s.conn.QueryRowContext(ctx, `SELECT value  FROM counters WHERE name = $1`, metric.ID)
-		err := row.Scan(&counterValue)
-		if err != nil {
-			if _, err := s.conn.ExecContext(ctx, "INSERT INTO counters (name, value) VALUES($1,$2)", metric.ID, metric.Delta); err != nil {
-				return nil, err
-			}
-		} else {
-			if _, err := s.conn.ExecContext(ctx, "UPDATE counters SET value=$1 where name=$2", *metric.Delta+counterValue, metric.ID); err != nil {
-				return nil, err
-			}
-		}
-		return metric, nil
+		err = s.breaker.Do(ctx, func(ctx context.Context) error {
+			return s.pool.QueryRow(ctx, upsertCounter, metric.ID, *metric.Delta).Scan(&stored.Delta)
+		})
 	case "gauge":
-		var gaugeValue float64
-		row := s.conn.QueryRowContext(ctx, `SELECT value  FROM gauges WHERE name = $1`, metric.ID)
-		err := row.Scan(&gaugeValue)
-		if err != nil {
-			if _, err := s.conn.ExecContext(ctx, "INSERT INTO gauges (name, value) VALUES($1,$2)", metric.ID, metric.Value); err != nil {
-				return nil, err
-			}
-		} else {
-			metric.Value = &gaugeValue
-			if _, err := s.conn.ExecContext(ctx, "UPDATE gauges SET value=$1 where name=$2", *metric.Value, metric.ID); err != nil {
-				return nil, err
-			}
-		}
-		return metric, nil
+		err = s.breaker.Do(ctx, func(ctx context.Context) error {
+			return s.pool.QueryRow(ctx, upsertGauge, metric.ID, *metric.Value).Scan(&stored.Value)
+		})
 	default:
 		return nil, errors.New("provided metric type is incorrect")
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	return stored, nil
 }
 
 func (s *PGStorage) GetMetric(ctx context.Context, metric *models.Metrics) (*models.Metrics, error) {
+	var query string
+	var dest any
 	switch metric.MType {
 	case "counter":
-		row := s.conn.QueryRowContext(ctx, `SELECT value  FROM counters WHERE name = $1`, metric.ID)
-		err := row.Scan(&metric.Delta)
-		if err != nil {
-			return nil, errors.New("can't find metric by provided name")
-		}
-		return metric, nil
+		query, dest = "SELECT value FROM counters WHERE name = $1", &metric.Delta
 	case "gauge":
-		row := s.conn.QueryRowContext(ctx, `SELECT value  FROM gauges WHERE name = $1`, metric.ID)
-		err := row.Scan(&metric.Value)
-		if err != nil {
-			return nil, errors.New("can't find metric by provided name")
-		}
-		return metric, nil
+		query, dest = "SELECT value FROM gauges WHERE name = $1", &metric.Value
 	default:
 		return nil, errors.New("provided metric type is incorrect")
 	}
+
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		return s.pool.QueryRow(ctx, query, metric.ID).Scan(dest)
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, models.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return metric, nil
+}
+
+const (
+	pageCounters = `SELECT name, value FROM counters WHERE name COLLATE "C" > $1 ORDER BY name COLLATE "C" LIMIT $2`
+	pageGauges   = `SELECT name, value FROM gauges WHERE name COLLATE "C" > $1 ORDER BY name COLLATE "C" LIMIT $2`
+)
+
+// ReadSeries returns up to limit series ordered by seriesKey, starting after
+// the series with the key after, so Copy can read the database a page at a
+// time. Names are compared byte by byte to match the order of seriesKey.
+func (s *PGStorage) ReadSeries(ctx context.Context, after string, limit int) ([]models.Metrics, error) {
+	afterType, afterID, _ := strings.Cut(after, ":")
+	var metrics []models.Metrics
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		metrics = make([]models.Metrics, 0, limit)
+		var err error
+		if afterType <= "counter" {
+			from := ""
+			if afterType == "counter" {
+				from = afterID
+			}
+			if metrics, err = readPage[int64](ctx, s.pool, pageCounters, "counter", from, limit, metrics); err != nil {
+				return err
+			}
+		}
+
+		if len(metrics) < limit {
+			from := ""
+			if afterType == "gauge" {
+				from = afterID
+			}
+			metrics, err = readPage[float64](ctx, s.pool, pageGauges, "gauge", from, limit-len(metrics), metrics)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return metrics, nil
+}
+
+func readPage[V int64 | float64](ctx context.Context, pool *pgxpool.Pool, query, mtype, after string, limit int, metrics []models.Metrics) ([]models.Metrics, error) {
+	rows, err := pool.Query(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var value V
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+
+		m := models.Metrics{ID: name, MType: mtype}
+		switch v := any(value).(type) {
+		case int64:
+			m.Delta = &v
+		case float64:
+			m.Value = &v
+		}
+		metrics = append(metrics, m)
+	}
+
+	return metrics, rows.Err()
+}
+
+// Snapshot reads both tables in one repeatable read transaction, so the
+// series are seen at a single point in time.
+func (s *PGStorage) Snapshot(ctx context.Context) ([]models.Metrics, error) {
+	var metrics []models.Metrics
+	err := s.breaker.Do(ctx, func(ctx context.Context) error {
+		opts := pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}
+		return pgx.BeginTxFunc(ctx, s.pool, opts, func(tx pgx.Tx) error {
+			rows, err := tx.Query(ctx, "SELECT name, value FROM gauges")
+			if err != nil {
+				return err
+			}
+			gauges := make(map[string]float64)
+			if err := scanValues(rows, gauges); err != nil {
+				return err
+			}
+
+			rows, err = tx.Query(ctx, "SELECT name, value FROM counters")
+			if err != nil {
+				return err
+			}
+			counters := make(map[string]int64)
+			if err := scanValues(rows, counters); err != nil {
+				return err
+			}
+
+			metrics = make([]models.Metrics, 0, len(gauges)+len(counters))
+			for id, v := range gauges {
+				metrics = append(metrics, models.Metrics{ID: id, MType: "gauge", Value: &v})
+			}
+			for id, d := range counters {
+				metrics = append(metrics, models.Metrics{ID: id, MType: "counter", Delta: &d})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return metrics, nil
+}
+
+func (s *PGStorage) Reset(ctx context.Context) error {
+	return s.breaker.Do(ctx, func(ctx context.Context) error {
+		_, err := s.pool.Exec(ctx, "TRUNCATE gauges, counters")
+		return err
+	})
 }
@@ -0,0 +1,175 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/migrations"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/pgretry"
+	"github.com/vladkonst/metrics-alerting/internal/storage"
+	"github.com/vladkonst/metrics-alerting/internal/storage/storagetest"
+)
+
+// testDB connects to the disposable database in TEST_DATABASE_DSN and
+// empties the metric tables.
+func testDB(tb testing.TB) *pgxpool.Pool {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		tb.Skip("TEST_DATABASE_DSN is not set")
+	}
+
+	ctx := context.Background()
+	db, err := pgxpool.New(ctx, dsn)
+	require.NoError(tb, err)
+	tb.Cleanup(db.Close)
+	_, err = migrations.Up(ctx, db)
+	require.NoError(tb, err)
+	_, err = db.Exec(ctx, "TRUNCATE counters, gauges")
+	require.NoError(tb, err)
+	return db
+}
+
+func TestPGStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) handlers.MetricRepository {
+		return storage.NewPGStorage(testDB(t), pgretry.NewBreaker(0, 0))
+	}, storagetest.Options{})
+}
+
+func TestPGStorageAddMetrics(t *testing.T) {
+	s := storage.NewPGStorage(testDB(t), pgretry.NewBreaker(0, 0))
+	ctx := context.Background()
+	_, err := s.AddMetric(ctx, &models.Metrics{ID: "c", MType: "counter", Delta: new(int64)})
+	require.NoError(t, err)
+
+	got, err := s.AddMetrics(ctx, []models.Metrics{storagetest.Counter("c", 1), storagetest.Gauge("g", 1), storagetest.Counter("c", 2), storagetest.Gauge("g", 2), storagetest.Counter("d", 5)})
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metrics{storagetest.Counter("c", 1), storagetest.Gauge("g", 1), storagetest.Counter("c", 3), storagetest.Gauge("g", 2), storagetest.Counter("d", 5)}, got)
+
+	stored, err := s.AddMetric(ctx, &models.Metrics{ID: "c", MType: "counter", Delta: got[0].Delta})
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *stored.Delta)
+	gauges, err := s.GetGaugesValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"g": 2}, gauges)
+}
+
+func batch(n int) []models.Metrics {
+	metrics := make([]models.Metrics, 0, n)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("m%d", i%(n/2+1))
+		if i%2 == 0 {
+			metrics = append(metrics, storagetest.Counter(id, int64(i)))
+		} else {
+			metrics = append(metrics, storagetest.Gauge(id, float64(i)))
+		}
+	}
+	return metrics
+}
+
+func BenchmarkPGStorageAddMetrics(b *testing.B) {
+	db := testDB(b)
+	s := storage.NewPGStorage(db, pgretry.NewBreaker(0, 0))
+	ctx := context.Background()
+	for _, n := range []int{10, 100, 1000} {
+		metrics := batch(n)
+		b.Run(fmt.Sprintf("upsert/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := s.AddMetrics(ctx, metrics); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("legacy/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := legacyAddMetrics(ctx, db, metrics); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// legacyAddMetrics is the select-then-write implementation the upserts
+// replaced, kept for comparison.
+func legacyAddMetrics(ctx context.Context, conn *pgxpool.Pool, metrics []models.Metrics) error {
+	addedCounters := make(map[string]int64)
+	addedGauges := make(map[string]bool)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+	for _, metric := range metrics {
+		switch metric.MType {
+		case "counter":
+			var counterValue int64
+			delta := *metric.Delta
+			row := conn.QueryRow(ctx, `SELECT value  FROM counters WHERE name = $1`, metric.ID)
+			err := row.Scan(&counterValue)
+			if _, ok := addedCounters[metric.ID]; err != nil && !ok {
+				if _, err := tx.Exec(ctx, "INSERT INTO counters (name, value) VALUES($1,$2)", metric.ID, delta); err != nil {
+					return err
+				}
+				addedCounters[metric.ID] += delta
+			} else {
+				if _, err := tx.Exec(ctx, "UPDATE counters SET value=$1 WHERE name=$2", addedCounters[metric.ID]+counterValue+delta, metric.ID); err != nil {
+					return err
+				}
+			}
+		case "gauge":
+			var gaugeName string
+			row := conn.QueryRow(ctx, `SELECT name  FROM gauges WHERE name = $1`, metric.ID)
+			err := row.Scan(&gaugeName)
+			if _, ok := addedGauges[metric.ID]; err != nil && !ok {
+				if _, err := tx.Exec(ctx, "INSERT INTO gauges (name, value) VALUES($1,$2)", metric.ID, *metric.Value); err != nil {
+					return err
+				}
+				addedGauges[metric.ID] = true
+			} else {
+				if _, err := tx.Exec(ctx, "UPDATE gauges SET value=$1 WHERE name=$2", *metric.Value, metric.ID); err != nil {
+					return err
+				}
+			}
+		default:
+			return errors.New("provided metric type is incorrect")
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func TestPGNotifier(t *testing.T) {
+	db := testDB(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	received := make(chan []string, 1)
+	go storage.NewPGNotifier(db, "second").Listen(ctx, func(keys []string) {
+		if keys != nil {
+			received <- keys
+		}
+	})
+
+	first := storage.NewPGNotifier(db, "first")
+	keys := []string{"counter:c", "gauge:g"}
+	require.Eventually(t, func() bool {
+		require.NoError(t, first.Notify(ctx, keys))
+		select {
+		case got := <-received:
+			assert.Equal(t, keys, got)
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/vladkonst/metrics-alerting/internal/logger"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+)
+
+const snapshotVersion = 1
+
+const (
+	EncodingJSON = "json"
+	EncodingGzip = "gzip"
+)
+
+var ErrCorruptSnapshot = errors.New("snapshot is corrupt")
+
+// SnapshotOptions controls how FileManager writes snapshots.
+type SnapshotOptions struct {
+	// Encoding of the snapshot body, EncodingJSON or EncodingGzip.
+	Encoding string
+	// Keep is the number of previous snapshots kept as path.1 … path.N.
+	Keep int
+}
+
+// snapshotHeader is the first line of a snapshot. The checksum is the
+// SHA-256 of the body that follows it.
+type snapshotHeader struct {
+	Version  int    `json:"version"`
+	Encoding string `json:"encoding"`
+	Count    int    `json:"count"`
+	Checksum string `json:"checksum"`
+}
+
+func ParseEncoding(s string) (string, error) {
+	switch s {
+	case EncodingJSON, EncodingGzip:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown snapshot encoding %q", s)
+	}
+}
+
+func seriesKey(m *models.Metrics) string {
+	return m.MType + ":" + m.ID
+}
+
+func encodeSnapshot(metrics map[string]models.Metrics, encoding string) ([]byte, error) {
+	list := make([]models.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		list = append(list, m)
+	}
+
+	body, err := json.Marshal(list)
+	if err != nil {
+		return nil, err
+	}
+
+	if encoding == EncodingGzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+
+	sum := sha256.Sum256(body)
+	header, err := json.Marshal(snapshotHeader{Version: snapshotVersion, Encoding: encoding, Count: len(list), Checksum: hex.EncodeToString(sum[:])})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append(header, '\n'), body...), nil
+}
+
+// decodeSnapshot reads both the versioned format and the legacy one, a
+// single JSON object keyed by metric name.
+func decodeSnapshot(data []byte) (map[string]models.Metrics, error) {
+	metrics := make(map[string]models.Metrics)
+	if len(bytes.TrimSpace(data)) == 0 {
+		return metrics, nil
+	}
+
+	line, body, _ := bytes.Cut(data, []byte("\n"))
+	var header snapshotHeader
+	if err := json.Unmarshal(line, &header); err != nil || header.Version == 0 {
+		legacy := make(map[string]models.Metrics)
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptSnapshot, err)
+		}
+		for _, m := range legacy {
+			metrics[seriesKey(&m)] = m
+		}
+		return metrics, nil
+	}
+
+	if header.Version > snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", header.Version)
+	}
+
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != header.Checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptSnapshot)
+	}
+
+	switch header.Encoding {
+	case EncodingJSON:
+	case EncodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptSnapshot, err)
+		}
+		if body, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCorruptSnapshot, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown snapshot encoding %q", header.Encoding)
+	}
+
+	list := make([]models.Metrics, 0, header.Count)
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorruptSnapshot, err)
+	}
+
+	for _, m := range list {
+		metrics[seriesKey(&m)] = m
+	}
+	return metrics, nil
+}
+
+func rotatedPath(path string, n int) string {
+	return path + "." + strconv.Itoa(n)
+}
+
+// writeSnapshot replaces the snapshot at path atomically: the data is written
+// to a temporary file which is synced and renamed over the old one. The old
+// one is linked into the history first, so path always holds a snapshot.
+func writeSnapshot(path string, data []byte, keep int) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	if _, err := w.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if keep > 0 {
+		if err := rotate(path, keep); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// rotate shifts the previous snapshots and makes path.1 a hard link to, or a
+// copy of, the current snapshot, leaving path itself in place.
+func rotate(path string, keep int) error {
+	for i := keep - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedPath(path, i), rotatedPath(path, i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	first := rotatedPath(path, 1)
+	if err := os.Remove(first); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	err := os.Link(path, first)
+	if err == nil || errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return copyFile(path, first)
+}
+
+// copyFile is the fallback for file systems without hard links.
+func copyFile(from, to string) error {
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// readSnapshot returns the newest valid snapshot out of path and its
+// rotated copies. Missing files yield an empty set of metrics.
+func readSnapshot(path string, keep int) (map[string]models.Metrics, error) {
+	log := logger.Get()
+	var lastErr error
+	for i := 0; i <= keep; i++ {
+		p := path
+		if i > 0 {
+			p = rotatedPath(path, i)
+		}
+
+		data, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			var metrics map[string]models.Metrics
+			if metrics, err = decodeSnapshot(data); err == nil {
+				if i > 0 {
+					log.Error().Err(lastErr).Str("file", p).Str("latest", path).
+						Msg("the latest snapshot is missing or unreadable, restored metrics from an older one; recent updates are lost")
+				}
+				return metrics, nil
+			}
+		}
+
+		log.Warn().Err(err).Str("file", p).Msg("skipping unreadable snapshot")
+		lastErr = err
+	}
+
+	if lastErr != nil {
+		return nil, fmt.Errorf("no valid snapshot found: %w", lastErr)
+	}
+	return make(map[string]models.Metrics), nil
+}
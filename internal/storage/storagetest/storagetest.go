@@ -0,0 +1,270 @@
+// Package storagetest checks that a handlers.MetricRepository behaves like
+// the in-memory storage.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/handlers"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+)
+
+// Factory returns an empty storage for a single test.
+type Factory func(t *testing.T) handlers.MetricRepository
+
+// Options turns off checks a backend doesn't support yet.
+type Options struct {
+	// SkipConcurrency skips the test writing from many goroutines.
+	SkipConcurrency bool
+}
+
+func Counter(id string, d int64) models.Metrics {
+	return models.Metrics{ID: id, MType: "counter", Delta: &d}
+}
+
+func Gauge(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+// Run runs the shared suite against storages made by newStorage.
+func Run(t *testing.T, newStorage Factory, opts Options) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s handlers.MetricRepository)
+	}{
+		{name: "counter accumulates test", test: testCounterAccumulates},
+		{name: "gauge replaces test", test: testGaugeReplaces},
+		{name: "batch running values test", test: testBatchRunningValues},
+		{name: "types are separate test", test: testTypesAreSeparate},
+		{name: "unknown metric test", test: testUnknownMetric},
+		{name: "invalid type test", test: testInvalidType},
+		{name: "values test", test: testValues},
+		{name: "canceled context test", test: testCanceledContext},
+		{name: "concurrent writes test", test: testConcurrentWrites},
+		{name: "snapshot and reset test", test: testSnapshotAndReset},
+		{name: "swap test", test: testSwap},
+		{name: "replace test", test: testReplace},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if opts.SkipConcurrency && test.name == "concurrent writes test" {
+				t.Skip("the storage is not safe for concurrent use")
+			}
+			test.test(t, newStorage(t))
+		})
+	}
+}
+
+func add(t *testing.T, s handlers.MetricRepository, m models.Metrics) models.Metrics {
+	stored, err := s.AddMetric(context.Background(), &m)
+	require.NoError(t, err)
+	return *stored
+}
+
+func get(t *testing.T, s handlers.MetricRepository, mtype, id string) models.Metrics {
+	found, err := s.GetMetric(context.Background(), &models.Metrics{ID: id, MType: mtype})
+	require.NoError(t, err)
+	return *found
+}
+
+func testCounterAccumulates(t *testing.T, s handlers.MetricRepository) {
+	assert.Equal(t, Counter("c", 1), add(t, s, Counter("c", 1)))
+	assert.Equal(t, Counter("c", 3), add(t, s, Counter("c", 2)))
+	assert.Equal(t, Counter("c", 3), get(t, s, "counter", "c"))
+}
+
+func testGaugeReplaces(t *testing.T, s handlers.MetricRepository) {
+	assert.Equal(t, Gauge("g", 1.5), add(t, s, Gauge("g", 1.5)))
+	assert.Equal(t, Gauge("g", -2), add(t, s, Gauge("g", -2)))
+	assert.Equal(t, Gauge("g", -2), get(t, s, "gauge", "g"))
+}
+
+func testBatchRunningValues(t *testing.T, s handlers.MetricRepository) {
+	add(t, s, Counter("c", 10))
+	stored, err := s.AddMetrics(context.Background(), []models.Metrics{Counter("c", 1), Gauge("g", 1), Counter("c", 2), Gauge("g", 2), Counter("d", 5)})
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metrics{Counter("c", 11), Gauge("g", 1), Counter("c", 13), Gauge("g", 2), Counter("d", 5)}, stored)
+	assert.Equal(t, Counter("c", 13), get(t, s, "counter", "c"))
+	assert.Equal(t, Gauge("g", 2), get(t, s, "gauge", "g"))
+}
+
+func testTypesAreSeparate(t *testing.T, s handlers.MetricRepository) {
+	add(t, s, Counter("m", 4))
+	add(t, s, Gauge("m", 0.5))
+	assert.Equal(t, Counter("m", 4), get(t, s, "counter", "m"))
+	assert.Equal(t, Gauge("m", 0.5), get(t, s, "gauge", "m"))
+}
+
+func testUnknownMetric(t *testing.T, s handlers.MetricRepository) {
+	add(t, s, Gauge("g", 1))
+	_, err := s.GetMetric(context.Background(), &models.Metrics{ID: "g", MType: "counter"})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+	_, err = s.GetMetric(context.Background(), &models.Metrics{ID: "missing", MType: "gauge"})
+	assert.ErrorIs(t, err, models.ErrNotFound)
+}
+
+func testInvalidType(t *testing.T, s handlers.MetricRepository) {
+	ctx := context.Background()
+	_, err := s.AddMetric(ctx, &models.Metrics{ID: "x", MType: "histogram"})
+	assert.Error(t, err)
+	_, err = s.AddMetrics(ctx, []models.Metrics{{ID: "x", MType: "histogram"}})
+	assert.Error(t, err)
+	_, err = s.GetMetric(ctx, &models.Metrics{ID: "x", MType: "histogram"})
+	assert.Error(t, err)
+}
+
+func testValues(t *testing.T, s handlers.MetricRepository) {
+	ctx := context.Background()
+	gauges, err := s.GetGaugesValues(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, gauges)
+
+	_, err = s.AddMetrics(ctx, []models.Metrics{Gauge("a", 1), Gauge("b", 2), Counter("a", 3), Counter("a", 4)})
+	require.NoError(t, err)
+	gauges, err = s.GetGaugesValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"a": 1, "b": 2}, gauges)
+	counters, err := s.GetCountersValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"a": 7}, counters)
+}
+
+func testCanceledContext(t *testing.T, s handlers.MetricRepository) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.AddMetric(ctx, &models.Metrics{ID: "c", MType: "counter", Delta: new(int64)})
+	assert.Error(t, err)
+	_, err = s.AddMetrics(ctx, []models.Metrics{Gauge("g", 1)})
+	assert.Error(t, err)
+	_, err = s.GetMetric(ctx, &models.Metrics{ID: "c", MType: "counter"})
+	assert.Error(t, err)
+	_, err = s.GetGaugesValues(ctx)
+	assert.Error(t, err)
+	_, err = s.GetCountersValues(ctx)
+	assert.Error(t, err)
+
+	_, err = s.GetMetric(context.Background(), &models.Metrics{ID: "c", MType: "counter"})
+	assert.Error(t, err, "nothing is stored with a canceled context")
+	_, err = s.GetMetric(context.Background(), &models.Metrics{ID: "g", MType: "gauge"})
+	assert.Error(t, err, "nothing is stored with a canceled context")
+}
+
+func testConcurrentWrites(t *testing.T, s handlers.MetricRepository) {
+	const workers, writes = 8, 50
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				one := Counter("c", 1)
+				if _, err := s.AddMetric(ctx, &one); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := s.AddMetrics(ctx, []models.Metrics{Counter("c", 1), Gauge("g", float64(w))}); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := s.GetCountersValues(ctx); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, Counter("c", 2*workers*writes), get(t, s, "counter", "c"))
+	g := get(t, s, "gauge", "g")
+	assert.GreaterOrEqual(t, *g.Value, 0.0)
+	assert.Less(t, *g.Value, float64(workers))
+}
+
+func testSnapshotAndReset(t *testing.T, s handlers.MetricRepository) {
+	ss, ok := s.(handlers.Snapshotter)
+	if !ok {
+		t.Skip("the storage has no snapshots")
+	}
+
+	ctx := context.Background()
+	_, err := s.AddMetrics(ctx, []models.Metrics{Gauge("g", 1.5), Counter("c", 2), Counter("c", 3)})
+	require.NoError(t, err)
+	metrics, err := ss.Snapshot(ctx)
+	require.NoError(t, err)
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].MType < metrics[j].MType })
+	assert.Equal(t, []models.Metrics{Counter("c", 5), Gauge("g", 1.5)}, metrics)
+
+	r, ok := s.(handlers.Resetter)
+	if !ok {
+		return
+	}
+
+	require.NoError(t, r.Reset(ctx))
+	metrics, err = ss.Snapshot(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, metrics)
+	_, err = s.GetMetric(ctx, &models.Metrics{ID: "c", MType: "counter"})
+	assert.Error(t, err)
+	assert.Equal(t, Counter("c", 1), add(t, s, Counter("c", 1)))
+}
+
+func testSwap(t *testing.T, s handlers.MetricRepository) {
+	sw, ok := s.(handlers.Swapper)
+	if !ok {
+		t.Skip("the storage doesn't return replaced values")
+	}
+
+	ctx := context.Background()
+	_, err := s.AddMetrics(ctx, []models.Metrics{Gauge("g", 1.5), Counter("c", 2)})
+	require.NoError(t, err)
+	stored, previous, err := sw.SwapMetrics(ctx, []models.Metrics{Gauge("g", 2.5), Counter("c", 3), Counter("c", 1), Counter("new", 4)})
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("the wrapped storage doesn't return replaced values")
+	}
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metrics{Gauge("g", 2.5), Counter("c", 5), Counter("c", 6), Counter("new", 4)}, stored)
+	g, c := Gauge("g", 1.5), Counter("c", 2)
+	assert.Equal(t, map[string]*models.Metrics{"gauge:g": &g, "counter:c": &c, "counter:new": nil}, previous)
+	assert.Equal(t, Counter("c", 6), get(t, s, "counter", "c"))
+}
+
+func testReplace(t *testing.T, s handlers.MetricRepository) {
+	r, ok := s.(handlers.Replacer)
+	if !ok {
+		t.Skip("the storage can't replace all series")
+	}
+
+	ctx := context.Background()
+	_, err := s.AddMetrics(ctx, []models.Metrics{Gauge("old", 1), Counter("c", 2)})
+	require.NoError(t, err)
+	stored, err := r.ReplaceMetrics(ctx, []models.Metrics{Counter("c", 3), Gauge("g", 1.5), Counter("c", 1)})
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("the wrapped storage can't replace all series")
+	}
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metrics{Counter("c", 3), Gauge("g", 1.5), Counter("c", 4)}, stored)
+
+	counters, err := s.GetCountersValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"c": 4}, counters)
+	gauges, err := s.GetGaugesValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"g": 1.5}, gauges)
+
+	_, err = r.ReplaceMetrics(ctx, []models.Metrics{Gauge("g", 2), {ID: "bad", MType: "histogram"}})
+	assert.Error(t, err)
+	gauges, err = s.GetGaugesValues(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"g": 1.5}, gauges, "a failed replace keeps the series")
+}
@@ -0,0 +1,382 @@
+// Package telemetry keeps the metrics a process collects about itself and
+// writes them in the Prometheus text format. Metrics are created once, e.g.
+// in package variables, and updated with their label values:
+//
+//	var requests = telemetry.Default.Counter("requests_total", "Handled requests.", "route")
+//
+//	requests.Inc("/update/")
+package telemetry
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/vladkonst/metrics-alerting/internal/models"
+)
+
+// DurationBuckets are the histogram buckets for latencies in seconds.
+var DurationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Default is the registry the server instruments itself with.
+var Default = NewRegistry("server")
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+type series struct {
+	labels []string
+	value  atomic.Uint64
+
+	mu      sync.Mutex
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+	fn     func() float64
+}
+
+// Registry holds the metrics of a process. Every name gets the namespace as
+// a prefix.
+type Registry struct {
+	namespace string
+	mu        sync.Mutex
+	families  map[string]*family
+}
+
+func NewRegistry(namespace string) *Registry {
+	return &Registry{namespace: namespace, families: make(map[string]*family)}
+}
+
+// register returns the family with the name, so packages instrumented more
+// than once share their metrics.
+func (r *Registry) register(f *family) *family {
+	if r.namespace != "" {
+		f.name = r.namespace + "_" + f.name
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.families[f.name]; ok {
+		if existing.kind != f.kind || len(existing.labels) != len(f.labels) {
+			panic(fmt.Sprintf("telemetry: %s registered twice with different kinds or labels", f.name))
+		}
+		return existing
+	}
+
+	f.series = make(map[string]*series)
+	r.families[f.name] = f
+	if len(f.labels) == 0 {
+		// Metrics without labels are reported as zero until first updated.
+		f.with(nil)
+	}
+	return f
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("telemetry: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), values...)}
+		if f.kind == kindHistogram {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func addFloat(v *atomic.Uint64, delta float64) {
+	for {
+		old := v.Load()
+		if v.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+type Counter struct{ f *family }
+
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(&family{name: name, help: help, kind: kindCounter, labels: labels})}
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Add ignores negative values, counters only go up.
+func (c *Counter) Add(v float64, labels ...string) {
+	if v < 0 {
+		return
+	}
+	addFloat(&c.f.with(labels).value, v)
+}
+
+type Gauge struct{ f *family }
+
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(&family{name: name, help: help, kind: kindGauge, labels: labels})}
+}
+
+func (g *Gauge) Set(v float64, labels ...string) {
+	g.f.with(labels).value.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) Add(v float64, labels ...string) {
+	addFloat(&g.f.with(labels).value, v)
+}
+
+// GaugeFunc reports the value of fn when the metrics are read. Registering
+// the name again replaces fn.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	f := r.register(&family{name: name, help: help, kind: kindGauge})
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fn = fn
+}
+
+type Histogram struct{ f *family }
+
+// Histogram counts observations in buckets with the given upper bounds.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Histogram{r.register(&family{name: name, help: help, kind: kindHistogram, labels: labels, buckets: b})}
+}
+
+func (h *Histogram) Observe(v float64, labels ...string) {
+	s := h.f.with(labels)
+	i := sort.SearchFloat64s(h.f.buckets, v)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i < len(s.buckets) {
+		s.buckets[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// Sample is a single value of a metric, histograms are reported as their
+// count and sum.
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+type histogramSample struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type familySnapshot struct {
+	*family
+	series     []*series
+	histograms []histogramSample
+	fn         func() float64
+}
+
+func (r *Registry) snapshot() []familySnapshot {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	snaps := make([]familySnapshot, 0, len(families))
+	for _, f := range families {
+		f.mu.Lock()
+		fs := familySnapshot{family: f, fn: f.fn, series: make([]*series, 0, len(f.series))}
+		for _, s := range f.series {
+			fs.series = append(fs.series, s)
+		}
+		f.mu.Unlock()
+		sort.Slice(fs.series, func(i, j int) bool {
+			return strings.Join(fs.series[i].labels, "\xff") < strings.Join(fs.series[j].labels, "\xff")
+		})
+
+		if f.kind == kindHistogram {
+			for _, s := range fs.series {
+				s.mu.Lock()
+				fs.histograms = append(fs.histograms, histogramSample{buckets: append([]uint64(nil), s.buckets...), count: s.count, sum: s.sum})
+				s.mu.Unlock()
+			}
+		}
+		snaps = append(snaps, fs)
+	}
+
+	return snaps
+}
+
+func (f *family) labelMap(values []string) map[string]string {
+	m := make(map[string]string, len(values))
+	for i, v := range values {
+		m[f.labels[i]] = v
+	}
+	return m
+}
+
+// Samples returns the current values sorted by name and labels.
+func (r *Registry) Samples() []Sample {
+	samples := make([]Sample, 0)
+	for _, fs := range r.snapshot() {
+		if fs.fn != nil {
+			samples = append(samples, Sample{Name: fs.name, Labels: map[string]string{}, Value: fs.fn()})
+			continue
+		}
+
+		for i, s := range fs.series {
+			labels := fs.labelMap(s.labels)
+			if fs.kind != kindHistogram {
+				samples = append(samples, Sample{Name: fs.name, Labels: labels, Value: math.Float64frombits(s.value.Load())})
+				continue
+			}
+
+			h := fs.histograms[i]
+			samples = append(samples,
+				Sample{Name: fs.name + "_count", Labels: labels, Value: float64(h.count)},
+				Sample{Name: fs.name + "_sum", Labels: labels, Value: h.sum})
+		}
+	}
+
+	return samples
+}
+
+// Metrics returns the samples as gauges. Label names and values are
+// appended to the name in label order, e.g.
+// server_http_requests_total_method_POST_route_update_status_200, so
+// samples that only differ in which label holds a value get distinct IDs.
+func (r *Registry) Metrics() []models.Metrics {
+	samples := r.Samples()
+	metrics := make([]models.Metrics, 0, len(samples))
+	for _, s := range samples {
+		id := s.Name
+		keys := make([]string, 0, len(s.Labels))
+		for k := range s.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			id += "_" + sanitize(k)
+			if v := sanitize(s.Labels[k]); v != "" {
+				id += "_" + v
+			}
+		}
+
+		v := s.Value
+		metrics = append(metrics, models.Metrics{ID: id, MType: "gauge", Value: &v})
+	}
+
+	return metrics
+}
+
+// sanitize keeps letters, digits and single underscores.
+func sanitize(s string) string {
+	var b strings.Builder
+	underscore := true
+	for _, c := range s {
+		if c < 128 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b.WriteRune(c)
+			underscore = false
+		} else if !underscore {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+extra[1]+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WriteText writes every metric in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, fs := range r.snapshot() {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", fs.name, fs.help, fs.name, fs.kind)
+		if fs.fn != nil {
+			fmt.Fprintf(bw, "%s %s\n", fs.name, formatFloat(fs.fn()))
+			continue
+		}
+
+		for i, s := range fs.series {
+			if fs.kind != kindHistogram {
+				fmt.Fprintf(bw, "%s%s %s\n", fs.name, formatLabels(fs.labels, s.labels), formatFloat(math.Float64frombits(s.value.Load())))
+				continue
+			}
+
+			h := fs.histograms[i]
+			var cumulative uint64
+			for j, le := range fs.buckets {
+				cumulative += h.buckets[j]
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", fs.name, formatLabels(fs.labels, s.labels, "le", formatFloat(le)), cumulative)
+			}
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", fs.name, formatLabels(fs.labels, s.labels, "le", "+Inf"), h.count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", fs.name, formatLabels(fs.labels, s.labels), formatFloat(h.sum))
+			fmt.Fprintf(bw, "%s_count%s %d\n", fs.name, formatLabels(fs.labels, s.labels), h.count)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.WriteText(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package telemetry_test
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/telemetry"
+)
+
+func TestWriteText(t *testing.T) {
+	r := telemetry.NewRegistry("test")
+	requests := r.Counter("requests_total", "Handled requests.", "route", "status")
+	requests.Inc("/update/", "200")
+	requests.Add(2, "/update/", "200")
+	requests.Add(-1, "/update/", "200")
+	r.Gauge("queue", "Queued items.").Set(3)
+	r.GaugeFunc("up", "Always one.", func() float64 { return 1 })
+	latency := r.Histogram("latency_seconds", "Latencies.", []float64{1, 0.1})
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteText(&buf))
+	assert.Equal(t, `# HELP test_latency_seconds Latencies.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.55
+test_latency_seconds_count 3
+# HELP test_queue Queued items.
+# TYPE test_queue gauge
+test_queue 3
+# HELP test_requests_total Handled requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/update/",status="200"} 3
+# HELP test_up Always one.
+# TYPE test_up gauge
+test_up 1
+`, buf.String())
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/metrics", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, buf.String(), w.Body.String())
+}
+
+func TestMetrics(t *testing.T) {
+	r := telemetry.NewRegistry("agent")
+	r.Counter("sent_total", "Sent batches.", "status").Inc("200 OK")
+	r.Histogram("batch_size", "Batch sizes.", []float64{10}).Observe(4)
+	pair := r.Gauge("pair", "Two labels.", "a", "b")
+	pair.Set(1, "x", "")
+	pair.Set(2, "", "x")
+
+	v := func(f float64) *float64 { return &f }
+	assert.ElementsMatch(t, []models.Metrics{
+		{ID: "agent_batch_size_count", MType: "gauge", Value: v(1)},
+		{ID: "agent_batch_size_sum", MType: "gauge", Value: v(4)},
+		{ID: "agent_pair_a_x_b", MType: "gauge", Value: v(1)},
+		{ID: "agent_pair_a_b_x", MType: "gauge", Value: v(2)},
+		{ID: "agent_sent_total_status_200_OK", MType: "gauge", Value: v(1)},
+	}, r.Metrics())
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := telemetry.NewRegistry("")
+	r.Counter("hits", "Hits.").Inc()
+	r.Counter("hits", "Hits.").Inc()
+	assert.Equal(t, []telemetry.Sample{{Name: "hits", Labels: map[string]string{}, Value: 2}}, r.Samples())
+	assert.Panics(t, func() { r.Gauge("hits", "Hits.") })
+}
+
+func TestUnlabelledStartAtZero(t *testing.T) {
+	r := telemetry.NewRegistry("")
+	r.Counter("errors_total", "Errors.")
+	r.Counter("retries_total", "Retries.", "reason")
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteText(&buf))
+	assert.Equal(t, `# HELP errors_total Errors.
+# TYPE errors_total counter
+errors_total 0
+# HELP retries_total Retries.
+# TYPE retries_total counter
+`, buf.String())
+}
@@ -0,0 +1,203 @@
+// Package tlsconfig builds server and agent TLS configurations from PEM files
+// that are reloaded when they change on disk.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vladkonst/metrics-alerting/internal/logger"
+)
+
+// Reloader holds a certificate with its key and a CA pool loaded from files.
+// Any of the files may be omitted.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+func NewReloader(certFile, keyFile, caFile string) (*Reloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("both certificate and key files are required")
+	}
+
+	r := &Reloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := make([]string, 0, 3)
+	for _, f := range []string{r.certFile, r.keyFile, r.caFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+
+	return files
+}
+
+// Reload reads the files again if any of them was modified since the last
+// load and reports whether it did. On error the previous state is kept.
+func (r *Reloader) Reload() (bool, error) {
+	modTimes := make(map[string]time.Time)
+	changed := r.modTimes == nil
+	for _, f := range r.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return false, err
+		}
+
+		modTimes[f] = fi.ModTime()
+		if !fi.ModTime().Equal(r.modTimes[f]) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return false, err
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		b, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return false, err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return false, fmt.Errorf("%s: no certificates found", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.pool, r.modTimes = cert, pool, modTimes
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Watch polls the files every interval until ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	log := logger.Get()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			changed, err := r.Reload()
+			if err != nil {
+				log.Error().Err(err).Msg("failed to reload TLS files")
+				continue
+			}
+			if changed {
+				log.Info().Strs("files", r.files()).Msg("TLS files reloaded")
+			}
+		}
+	}
+}
+
+func (r *Reloader) certificate() (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return nil, errors.New("no certificate configured")
+	}
+
+	return r.cert, nil
+}
+
+func (r *Reloader) CertPool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
+
+// ServerConfig serves the current certificate. With a CA file client
+// certificates are verified against it: they are mandatory when
+// requireClientCert is set and optional otherwise. Without a CA file
+// requireClientCert fails every handshake.
+func ServerConfig(r *Reloader, requireClientCert bool) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+					return r.certificate()
+				},
+			}
+			if pool := r.CertPool(); pool != nil {
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				if requireClientCert {
+					cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			} else if requireClientCert {
+				return nil, errors.New("client certificates are required but no client CA is configured")
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig presents the current certificate, if any, and verifies the
+// server against the current CA pool or the system roots when no CA file is
+// configured. Verification is done by hand so a reloaded CA takes effect on
+// the next connection.
+func ClientConfig(r *Reloader) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			if r.cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return r.cert, nil
+		},
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         r.CertPool(),
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, c := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(c)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
@@ -0,0 +1,128 @@
+package tokens
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileStore keeps tokens in a JSON file. The file is read again when it was
+// changed, so tokens issued or revoked from the command line take effect on a
+// running server.
+type FileStore struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	tokens  []Token
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (s *FileStore) load() error {
+	fi, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.tokens, s.modTime = nil, time.Time{}
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if fi.ModTime().Equal(s.modTime) && s.tokens != nil {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	tokens := make([]Token, 0)
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &tokens); err != nil {
+			return err
+		}
+	}
+
+	s.tokens, s.modTime = tokens, fi.ModTime()
+	return nil
+}
+
+func (s *FileStore) save(tokens []Token) error {
+	b, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	s.tokens, s.modTime = nil, time.Time{}
+	return nil
+}
+
+func (s *FileStore) Create(ctx context.Context, t Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	return s.save(append(s.tokens, t))
+}
+
+func (s *FileStore) Revoke(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+
+	for i := range s.tokens {
+		if s.tokens[i].ID == id {
+			now := time.Now().UTC()
+			s.tokens[i].RevokedAt = &now
+			return s.save(s.tokens)
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (s *FileStore) FindByHash(ctx context.Context, hash string) (*Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	for _, t := range s.tokens {
+		if t.Hash == hash {
+			return &t, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (s *FileStore) List(ctx context.Context) ([]Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return append([]Token{}, s.tokens...), nil
+}
@@ -0,0 +1,92 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PGStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPGStore expects the api_tokens table to be created by the migrations
+// package.
+func NewPGStore(pool *pgxpool.Pool) *PGStore {
+	return &PGStore{pool: pool}
+}
+
+func (s *PGStore) Create(ctx context.Context, t Token) error {
+	scopes := make([]string, 0, len(t.Scopes))
+	for _, sc := range t.Scopes {
+		scopes = append(scopes, string(sc))
+	}
+
+	_, err := s.pool.Exec(ctx, "INSERT INTO api_tokens (id, name, hash, scopes, created_at) VALUES($1,$2,$3,$4,$5)",
+		t.ID, t.Name, t.Hash, strings.Join(scopes, ","), t.CreatedAt)
+	return err
+}
+
+func (s *PGStore) Revoke(ctx context.Context, id string) error {
+	res, err := s.pool.Exec(ctx, "UPDATE api_tokens SET revoked_at=$1 WHERE id=$2 AND revoked_at IS NULL", time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+
+	if res.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (s *PGStore) FindByHash(ctx context.Context, hash string) (*Token, error) {
+	row := s.pool.QueryRow(ctx, "SELECT id, name, hash, scopes, created_at, revoked_at FROM api_tokens WHERE hash = $1", hash)
+	t, err := scanToken(row)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	return t, err
+}
+
+func (s *PGStore) List(ctx context.Context) ([]Token, error) {
+	rows, err := s.pool.Query(ctx, "SELECT id, name, hash, scopes, created_at, revoked_at FROM api_tokens ORDER BY created_at")
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+	tokens := make([]Token, 0)
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+
+	return tokens, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanToken(row scanner) (*Token, error) {
+	var t Token
+	var scopes string
+	if err := row.Scan(&t.ID, &t.Name, &t.Hash, &scopes, &t.CreatedAt, &t.RevokedAt); err != nil {
+		return nil, err
+	}
+
+	for _, sc := range strings.Split(scopes, ",") {
+		t.Scopes = append(t.Scopes, Scope(sc))
+	}
+
+	return &t, nil
+}
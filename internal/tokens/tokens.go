@@ -0,0 +1,113 @@
+// Package tokens manages bearer tokens for the server API. Only SHA-256
+// hashes of the token secrets are stored.
+package tokens
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Scope string
+
+const (
+	ScopeRead  Scope = "read"
+	ScopeWrite Scope = "write"
+	ScopeAdmin Scope = "admin"
+)
+
+var (
+	ErrNotFound = errors.New("token not found")
+	ErrRevoked  = errors.New("token is revoked")
+)
+
+type Token struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Hash      string     `json:"hash"`
+	Scopes    []Scope    `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Allows reports whether the token grants the scope. The admin scope grants
+// every other scope.
+func (t *Token) Allows(s Scope) bool {
+	return slices.Contains(t.Scopes, s) || slices.Contains(t.Scopes, ScopeAdmin)
+}
+
+type Store interface {
+	Create(context.Context, Token) error
+	Revoke(ctx context.Context, id string) error
+	FindByHash(ctx context.Context, hash string) (*Token, error)
+	List(context.Context) ([]Token, error)
+}
+
+func ParseScopes(s string) ([]Scope, error) {
+	scopes := make([]Scope, 0)
+	for _, v := range strings.Split(s, ",") {
+		switch sc := Scope(strings.TrimSpace(v)); sc {
+		case ScopeRead, ScopeWrite, ScopeAdmin:
+			if !slices.Contains(scopes, sc) {
+				scopes = append(scopes, sc)
+			}
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown scope %q", v)
+		}
+	}
+
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+
+	return scopes, nil
+}
+
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue creates a token and returns its secret, which is not stored anywhere
+// and can't be recovered later.
+func Issue(ctx context.Context, store Store, name string, scopes []Scope) (string, *Token, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	s := "mt_" + base64.RawURLEncoding.EncodeToString(secret)
+	t := Token{ID: hex.EncodeToString(id), Name: name, Hash: Hash(s), Scopes: scopes, CreatedAt: time.Now().UTC()}
+	if err := store.Create(ctx, t); err != nil {
+		return "", nil, err
+	}
+
+	return s, &t, nil
+}
+
+// Authenticate returns the active token with the given secret.
+func Authenticate(ctx context.Context, store Store, secret string) (*Token, error) {
+	t, err := store.FindByHash(ctx, Hash(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	if t.RevokedAt != nil {
+		return nil, ErrRevoked
+	}
+
+	return t, nil
+}
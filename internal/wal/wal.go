@@ -0,0 +1,242 @@
+// Package wal implements an append-only write-ahead log of metric states.
+//
+// Every record is laid out as
+//
+//	payload length (4 bytes) | CRC-32C of the payload (4 bytes) | JSON encoded models.Metrics
+//
+// with integers in big endian. A record that is cut short or fails the
+// checksum marks the end of the log: it and everything after it is discarded
+// when the log is opened.
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vladkonst/metrics-alerting/internal/logger"
+	"github.com/vladkonst/metrics-alerting/internal/models"
+)
+
+type SyncPolicy string
+
+const (
+	// SyncAlways fsyncs after every record.
+	SyncAlways SyncPolicy = "always"
+	// SyncInterval fsyncs pending records periodically.
+	SyncInterval SyncPolicy = "interval"
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = "never"
+)
+
+const (
+	headerSize = 8
+	// MaxRecordSize bounds the payload length read from a record header,
+	// so a corrupt header can't make replay allocate gigabytes. Metrics
+	// encode to a few hundred bytes.
+	MaxRecordSize = 1 << 20
+)
+
+// ErrRecordTooLarge is returned by Append for records over MaxRecordSize.
+var ErrRecordTooLarge = errors.New("WAL record is too large")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch p := SyncPolicy(s); p {
+	case SyncAlways, SyncInterval, SyncNever:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown WAL sync policy %q", s)
+	}
+}
+
+type Log struct {
+	mu     sync.Mutex
+	file   *os.File
+	policy SyncPolicy
+	dirty  bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Open opens or creates the log and returns the records it holds. A torn or
+// corrupt tail is truncated so new records are appended after the last valid
+// one.
+func Open(path string, policy SyncPolicy, interval time.Duration) (*Log, []models.Metrics, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, size, err := readRecords(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	l := &Log{file: f, policy: policy, done: make(chan struct{})}
+	if policy == SyncInterval {
+		if interval <= 0 {
+			interval = time.Second
+		}
+		l.wg.Add(1)
+		go l.syncLoop(interval)
+	}
+
+	return l, records, nil
+}
+
+func readRecords(r io.Reader) ([]models.Metrics, int64, error) {
+	log := logger.Get()
+	records := make([]models.Metrics, 0)
+	var size int64
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Warn().Int64("offset", size).Msg("WAL ends with a torn record header, discarding it")
+			} else if !errors.Is(err, io.EOF) {
+				return nil, 0, err
+			}
+			return records, size, nil
+		}
+
+		n := binary.BigEndian.Uint32(header[:4])
+		if n > MaxRecordSize {
+			log.Warn().Int64("offset", size).Uint32("length", n).Msg("WAL record length is corrupt, discarding the rest of the log")
+			return records, size, nil
+		}
+
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				log.Warn().Int64("offset", size).Msg("WAL ends with a torn record, discarding it")
+				return records, size, nil
+			}
+			return nil, 0, err
+		}
+
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+			log.Warn().Int64("offset", size).Msg("WAL record checksum mismatch, discarding the rest of the log")
+			return records, size, nil
+		}
+
+		var m models.Metrics
+		if err := json.Unmarshal(payload, &m); err != nil {
+			log.Warn().Int64("offset", size).Err(err).Msg("WAL record can't be decoded, discarding the rest of the log")
+			return records, size, nil
+		}
+
+		records = append(records, m)
+		size += int64(headerSize) + int64(n)
+	}
+}
+
+// Append writes the records with a single write and, with SyncAlways, a
+// single fsync.
+func (l *Log) Append(metrics ...models.Metrics) error {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		payload, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if len(payload) > MaxRecordSize {
+			return ErrRecordTooLarge
+		}
+
+		buf.Grow(headerSize + len(payload))
+		binary.Write(&buf, binary.BigEndian, uint32(len(payload)))
+		binary.Write(&buf, binary.BigEndian, crc32.Checksum(payload, crcTable))
+		buf.Write(payload)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	if l.policy == SyncAlways {
+		return l.file.Sync()
+	}
+
+	l.dirty = true
+	return nil
+}
+
+// Truncate drops all records. It is called once their effects are persisted
+// in a snapshot.
+func (l *Log) Truncate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	l.dirty = false
+	return l.file.Sync()
+}
+
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.dirty {
+		return nil
+	}
+
+	l.dirty = false
+	return l.file.Sync()
+}
+
+func (l *Log) syncLoop(interval time.Duration) {
+	defer l.wg.Done()
+	log := logger.Get()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+			if err := l.Sync(); err != nil {
+				log.Error().Err(err).Msg("failed to sync WAL")
+			}
+		}
+	}
+}
+
+func (l *Log) Close() error {
+	close(l.done)
+	l.wg.Wait()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+
+	return l.file.Close()
+}
@@ -0,0 +1,119 @@
+package wal_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/vladkonst/metrics-alerting/internal/models"
+	"github.com/vladkonst/metrics-alerting/internal/wal"
+)
+
+func gauge(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+func writeLog(t *testing.T, policy wal.SyncPolicy, metrics ...models.Metrics) string {
+	path := filepath.Join(t.TempDir(), "metrics.wal")
+	l, records, err := wal.Open(path, policy, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Empty(t, records)
+	for _, m := range metrics {
+		require.NoError(t, l.Append(m))
+	}
+	require.NoError(t, l.Close())
+	return path
+}
+
+func TestReplay(t *testing.T) {
+	metrics := []models.Metrics{gauge("a", 1), gauge("b", 2), gauge("a", 3)}
+	tests := []struct {
+		name    string
+		policy  wal.SyncPolicy
+		corrupt func(t *testing.T, path string)
+		want    []models.Metrics
+	}{
+		{name: "always sync test", policy: wal.SyncAlways, want: metrics},
+		{name: "interval sync test", policy: wal.SyncInterval, want: metrics},
+		{name: "never sync test", policy: wal.SyncNever, want: metrics},
+		{
+			name:   "torn record test",
+			policy: wal.SyncAlways,
+			corrupt: func(t *testing.T, path string) {
+				info, err := os.Stat(path)
+				require.NoError(t, err)
+				require.NoError(t, os.Truncate(path, info.Size()-3))
+			},
+			want: metrics[:2],
+		},
+		{
+			name:   "checksum mismatch test",
+			policy: wal.SyncAlways,
+			corrupt: func(t *testing.T, path string) {
+				b, err := os.ReadFile(path)
+				require.NoError(t, err)
+				b[len(b)-2] ^= 0xff
+				require.NoError(t, os.WriteFile(path, b, 0666))
+			},
+			want: metrics[:2],
+		},
+		{
+			name:   "corrupt length test",
+			policy: wal.SyncAlways,
+			corrupt: func(t *testing.T, path string) {
+				f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+				require.NoError(t, err)
+				_, err = f.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, '{'})
+				require.NoError(t, err)
+				require.NoError(t, f.Close())
+			},
+			want: metrics,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeLog(t, test.policy, metrics...)
+			if test.corrupt != nil {
+				test.corrupt(t, path)
+			}
+
+			l, records, err := wal.Open(path, test.policy, time.Second)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, records)
+
+			require.NoError(t, l.Append(gauge("c", 4)))
+			require.NoError(t, l.Close())
+			_, records, err = wal.Open(path, wal.SyncNever, 0)
+			require.NoError(t, err)
+			assert.Equal(t, append(test.want, gauge("c", 4)), records)
+		})
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	path := writeLog(t, wal.SyncAlways, gauge("a", 1))
+	l, records, err := wal.Open(path, wal.SyncAlways, 0)
+	require.NoError(t, err)
+	assert.Len(t, records, 1)
+
+	require.NoError(t, l.Truncate())
+	require.NoError(t, l.Append(gauge("b", 2)))
+	require.NoError(t, l.Close())
+
+	_, records, err = wal.Open(path, wal.SyncAlways, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []models.Metrics{gauge("b", 2)}, records)
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	p, err := wal.ParseSyncPolicy("interval")
+	require.NoError(t, err)
+	assert.Equal(t, wal.SyncInterval, p)
+	_, err = wal.ParseSyncPolicy("sometimes")
+	assert.Error(t, err)
+}